@@ -0,0 +1,225 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// outboundConfig is the access control list of servers for the targets
+// clients may reach. Entries of allow and deny are CIDRs, IPs, or domains
+// which match themselves and their subdomains.
+type outboundConfig struct {
+	Allow   []string    `json:"allow"`   // allowed even if private
+	Deny    []string    `json:"deny"`    // denied even if allowed
+	Ports   []portRange `json:"ports"`   // allowed ports; all if empty
+	Default string      `json:"default"` // "allow" (the default) or "deny" for the others
+}
+
+// A portRange is a port or an inclusive range of ports, given in JSON as a
+// number or a string like "8000-9000".
+type portRange struct{ lo, hi uint16 }
+
+func (r *portRange) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	l, err1 := strconv.ParseUint(lo, 10, 16)
+	h, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || l > h {
+		return fmt.Errorf("invalid port range %s", b)
+	}
+	*r = portRange{uint16(l), uint16(h)}
+	return nil
+}
+
+// An acl is an outboundConfig ready to check targets with.
+type acl struct {
+	allow, deny rules
+	ports       []portRange
+	denyOthers  bool
+}
+
+type rules struct {
+	nets    []netip.Prefix
+	domains []string
+}
+
+// outbound is the ACL of running servers.
+var outbound atomic.Pointer[acl]
+
+// errDenied means that the ACL of servers denies a target.
+var errDenied = errors.New("target denied")
+
+// Ranges denied unless allowed explicitly, besides loopback, private,
+// link-local, multicast and unspecified addresses.
+var blockedNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, also used inside clouds
+}
+
+func (c *outboundConfig) acl() (*acl, error) {
+	a := new(acl)
+	if c == nil {
+		return a, nil
+	}
+	var err error
+	if a.allow, err = parseRules(c.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %v", err)
+	}
+	if a.deny, err = parseRules(c.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %v", err)
+	}
+	a.ports = c.Ports
+	switch c.Default {
+	case "", "allow":
+	case "deny":
+		a.denyOthers = true
+	default:
+		return nil, fmt.Errorf("default %q: want allow or deny", c.Default)
+	}
+	return a, nil
+}
+
+func parseRules(entries []string) (rules, error) {
+	var r rules
+	for _, e := range entries {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			r.nets = append(r.nets, p.Masked())
+		} else if ip, err := netip.ParseAddr(e); err == nil {
+			r.nets = append(r.nets, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+		} else if d := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(e, "*"), ".")); d != "" && !strings.ContainsAny(d, "/: ") {
+			r.domains = append(r.domains, d)
+		} else {
+			return r, fmt.Errorf("invalid entry %q", e)
+		}
+	}
+	return r, nil
+}
+
+func (r rules) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rules) matchIP(ip netip.Addr) bool {
+	for _, p := range r.nets {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowPort reports whether port is allowed.
+func (a *acl) allowPort(port uint16) bool {
+	if len(a.ports) == 0 {
+		return true
+	}
+	for _, r := range a.ports {
+		if r.lo <= port && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// allowIP reports whether ip resolved from host, which is empty for IP
+// targets, is allowed.
+func (a *acl) allowIP(host string, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	switch {
+	case a.deny.matchIP(ip), host != "" && a.deny.matchDomain(host):
+		return false
+	case a.allow.matchIP(ip), host != "" && a.allow.matchDomain(host):
+		return true
+	case ip.IsLoopback(), ip.IsPrivate(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(),
+		ip.IsInterfaceLocalMulticast(), ip.IsMulticast(), ip.IsUnspecified():
+		return false
+	}
+	for _, p := range blockedNets {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return !a.denyOthers
+}
+
+// resolveTarget resolves target for servers to reach, keeping the addresses
+// the ACL allows. It fails with errDenied if none are.
+func resolveTarget(target string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	a := outbound.Load()
+	if a == nil {
+		a = new(acl)
+	}
+	if !a.allowPort(uint16(port)) {
+		return nil, errDenied
+	}
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips, host = []netip.Addr{ip}, ""
+	} else {
+		if a.deny.matchDomain(host) {
+			return nil, errDenied
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+
+	var addrs []netip.AddrPort
+	for _, ip := range ips {
+		if a.allowIP(host, ip) {
+			addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errDenied
+	}
+	slices.SortStableFunc(addrs, func(a, b netip.AddrPort) int { // IPv4 first as net.ResolveUDPAddr
+		return cmp.Compare(a.Addr().BitLen(), b.Addr().BitLen())
+	})
+	return addrs, nil
+}
+
+// dialTarget connects to target for clients of servers, trying the
+// addresses the ACL allows in turn.
+func dialTarget(target string) (net.Conn, error) {
+	addrs, err := resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var c net.Conn
+		if c, err = net.Dial("tcp", addr.String()); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
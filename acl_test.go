@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+)
+
+func TestACLAllowIP(t *testing.T) {
+	var c outboundConfig
+	err := json.Unmarshal([]byte(`{
+		"allow": ["10.1.0.0/16", "intranet.example", "fd00::1"],
+		"deny": ["203.0.113.0/24", "*.blocked.example", "10.1.2.3"],
+		"ports": [443, "8000-8080"]
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := c.acl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		host, ip string
+		want     bool
+	}{
+		{"", "93.184.216.34", true},
+		{"", "127.0.0.1", false},
+		{"", "::ffff:127.0.0.1", false},
+		{"", "::1", false},
+		{"", "192.168.1.1", false},
+		{"", "169.254.169.254", false},
+		{"", "100.100.100.200", false},
+		{"", "0.0.0.0", false},
+		{"", "10.1.9.9", true},
+		{"", "10.1.2.3", false},
+		{"", "10.2.0.1", false},
+		{"", "fd00::1", true},
+		{"", "fd00::2", false},
+		{"", "203.0.113.5", false},
+		{"intranet.example", "10.9.9.9", true},
+		{"a.intranet.example", "192.168.0.1", true},
+		{"www.blocked.example", "93.184.216.34", false},
+		{"notblocked.example", "93.184.216.34", true},
+	} {
+		if got := a.allowIP(tt.host, netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("allowIP(%q, %s) = %v, want %v", tt.host, tt.ip, got, tt.want)
+		}
+	}
+
+	for port, want := range map[uint16]bool{443: true, 80: false, 8000: true, 8080: true, 8081: false} {
+		if got := a.allowPort(port); got != want {
+			t.Errorf("allowPort(%d) = %v, want %v", port, got, want)
+		}
+	}
+
+	a.denyOthers = true
+	if a.allowIP("", netip.MustParseAddr("93.184.216.34")) {
+		t.Error("public address allowed by default deny")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// credentialConfig is an entry in the credentials file of a proxy listener.
+type credentialConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// credentials are the passwords of the users that clients of a proxy
+// listener authenticate as, by name. A nil credentials requires none.
+type credentials map[string]string
+
+// loadCredentials reads a JSON array of names and passwords from path.
+func loadCredentials(path string) (credentials, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ccs []credentialConfig
+	if err := json.Unmarshal(b, &ccs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	creds := make(credentials, len(ccs))
+	for i, cc := range ccs {
+		if cc.Name == "" {
+			return nil, fmt.Errorf("%s: user #%d: missing name", path, i+1)
+		}
+		if len(cc.Name) > 255 || len(cc.Password) > 255 {
+			return nil, fmt.Errorf("%s: user %s: name and password must be at most 255 bytes", path, cc.Name)
+		}
+		if _, ok := creds[cc.Name]; ok {
+			return nil, fmt.Errorf("%s: user %s: duplicate name", path, cc.Name)
+		}
+		creds[cc.Name] = cc.Password
+	}
+	return creds, nil
+}
+
+// check reports whether password is that of user.
+func (cr credentials) check(user, password string) bool {
+	want, ok := cr[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
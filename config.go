@@ -0,0 +1,705 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const defaultCipher = "AEAD_CHACHA20_POLY1305"
+
+// Modes of servers, listeners and tunnels, as in shadowsocks-libev.
+const (
+	modeTCPOnly   = "tcp_only"
+	modeUDPOnly   = "udp_only"
+	modeTCPAndUDP = "tcp_and_udp"
+)
+
+// fileConfig is the configuration read from the JSON file of -config and
+// overridden by flags. It understands the keys of the config.json of
+// shadowsocks-libev, which describe a single server and SOCKS listener, and
+// extends them with lists of servers, listeners and tunnels.
+type fileConfig struct {
+	Role string `json:"role"` // "server" or "client"; guessed from listeners and tunnels if empty
+
+	Server       hostList `json:"server"` // a host or a list of hosts
+	ServerPort   int      `json:"server_port"`
+	Password     string   `json:"password"`
+	Key          string   `json:"key"`
+	Method       string   `json:"method"`
+	Plugin       string   `json:"plugin"`
+	PluginOpts   string   `json:"plugin_opts"`
+	LocalAddress string   `json:"local_address"`
+	LocalPort    int      `json:"local_port"`
+	Mode         string   `json:"mode"`
+	Timeout      seconds  `json:"timeout"`            // UDP session timeout, and TCP idle timeout as in libev
+	Shutdown     *seconds `json:"shutdown_timeout"`   // for connections to finish on shutdown
+	Handshake    *seconds `json:"handshake_timeout"`  // for TCP clients to send the target address
+	Idle         *seconds `json:"idle_timeout"`       // for TCP relays idle in both directions to close; 0 disables
+	HalfClose    *seconds `json:"half_close_timeout"` // for one direction of TCP relays to finish after the other
+	TrafficLog   seconds  `json:"traffic_log"`        // between logs of traffic per port and user; 0 disables
+	Users        string   `json:"users"`
+	Timestamp    bool     `json:"timestamp"`
+	QuotaFile    string   `json:"quota_file"`      // to keep the quota usage of users in across restarts
+	SaltFile     string   `json:"salt_file"`       // to keep the salt filter in across restarts
+	Manager      string   `json:"manager_address"` // UDP address or unix socket path of the manager API
+	Metrics      string   `json:"metrics_address"` // address to serve Prometheus metrics on
+	Verbose      bool     `json:"verbose"`
+	LogLevel     string   `json:"log_level"`  // debug, info, warn or error; debug if verbose, info otherwise
+	LogFormat    string   `json:"log_format"` // text or json
+	AccessLog    string   `json:"access_log"` // file to record relays in, "-" for stderr
+	TCPCork      bool     `json:"tcp_cork"`
+	DeferReply   bool     `json:"defer_reply"` // reply to SOCKS5 CONNECT once connected to the server
+
+	Servers    []serverConfig    `json:"servers"`
+	Listeners  []listenerConfig  `json:"listeners"`
+	Tunnels    []tunnelConfig    `json:"tunnels"`
+	Outbound   *outboundConfig   `json:"outbound"`
+	Inbound    *inboundConfig    `json:"inbound"`
+	Fallback   string            `json:"fallback"`    // address to proxy clients failing to authenticate to
+	RateLimit  *rateLimit        `json:"rate_limit"`  // of all servers together
+	SaltFilter *saltFilterConfig `json:"salt_filter"` // of servers without their own
+
+	acl    *acl
+	policy *inboundPolicy
+}
+
+// serverConfig is a server to serve, or to connect to on clients. Method and
+// Mode default to those at the top level of the file.
+type serverConfig struct {
+	Name       string            `json:"name"` // referred to by listeners and tunnels; the address if empty
+	Address    string            `json:"address"`
+	Method     string            `json:"method"`
+	Password   string            `json:"password"`
+	Key        string            `json:"key"` // base64url-encoded
+	Plugin     string            `json:"plugin"`
+	PluginOpts string            `json:"plugin_opts"`
+	Mode       string            `json:"mode"`
+	Users      string            `json:"users"`     // JSON file of users of a multi-user server
+	Timestamp  bool              `json:"timestamp"` // timestamp extension of legacy AEAD ciphers
+	RateLimit  *rateLimit        `json:"rate_limit"`
+	SaltFilter *saltFilterConfig `json:"salt_filter"`
+
+	ciph        core.Cipher
+	userConfigs []userConfig // of the users file
+	saltFilters []string     // IDs of the salt filters of the server and its users
+}
+
+// listenerConfig is a proxy or redirect listener of a client.
+type listenerConfig struct {
+	Type    string `json:"type"` // "socks", "http", "mixed", "redir" or "redir6"
+	Address string `json:"address"`
+	UDP     bool   `json:"udp"`    // UDP support for SOCKS5
+	Auth    string `json:"auth"`   // JSON file of names and passwords of clients of SOCKS5 and HTTP proxies
+	Server  string `json:"server"` // name of the server; the first if empty
+
+	srv   *serverConfig
+	creds credentials // of the auth file
+}
+
+// tunnelConfig is a tunnel from a local address to a remote one via a server.
+type tunnelConfig struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Mode   string `json:"mode"`
+	Server string `json:"server"` // name of the server; the first if empty
+
+	srv *serverConfig
+}
+
+// hostList is a host or a list of hosts in JSON.
+type hostList []string
+
+func (h *hostList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*h = hostList{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(h))
+}
+
+// seconds is a duration given in JSON as a number of seconds, which may
+// have a fraction.
+type seconds time.Duration
+
+func (s *seconds) UnmarshalJSON(b []byte) error {
+	var f float64
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("invalid number of seconds %s", b)
+	}
+	*s = seconds(f * float64(time.Second))
+	return nil
+}
+
+func (s seconds) String() string { return time.Duration(s).String() }
+
+// loadConfig reads the configuration file at path.
+func loadConfig(path string) (*fileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(fileConfig)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	c.normalize()
+	return c, nil
+}
+
+// normalize turns the keys of shadowsocks-libev into entries of the server
+// and listener lists.
+func (c *fileConfig) normalize() {
+	var servers []serverConfig
+	// managers may only give the hosts to listen on for the ports they add
+	if c.ServerPort != 0 || len(c.Server) > 0 && c.Manager == "" {
+		hosts := c.Server
+		if len(hosts) == 0 {
+			hosts = hostList{""}
+		}
+		for _, h := range hosts {
+			servers = append(servers, serverConfig{
+				Address:    net.JoinHostPort(h, strconv.Itoa(c.ServerPort)),
+				Password:   c.Password,
+				Key:        c.Key,
+				Plugin:     c.Plugin,
+				PluginOpts: c.PluginOpts,
+				Users:      c.Users,
+				Timestamp:  c.Timestamp,
+			})
+		}
+	}
+	c.Servers = append(servers, c.Servers...)
+	for i := range c.Servers {
+		if c.Servers[i].Method == "" {
+			c.Servers[i].Method = c.Method
+		}
+		if c.Servers[i].Mode == "" {
+			c.Servers[i].Mode = c.Mode
+		}
+	}
+
+	if c.LocalPort != 0 {
+		host := c.LocalAddress
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		l := listenerConfig{Type: "socks", Address: net.JoinHostPort(host, strconv.Itoa(c.LocalPort)), UDP: hasUDP(c.Mode)}
+		c.Listeners = append([]listenerConfig{l}, c.Listeners...)
+	}
+
+	if c.Role == "" {
+		c.Role = "server"
+		if len(c.Listeners) > 0 || len(c.Tunnels) > 0 {
+			c.Role = "client"
+		}
+	}
+}
+
+// applyFlags overrides c with the flags in set. Flags about servers apply to
+// the first one, or without any to the top-level keys which servers added
+// through the manager start from; -socks, -http, -mixed, -redir and
+// -redir6 replace listeners of their type; -tcptun and -udptun replace all tunnels.
+func (c *fileConfig) applyFlags(set map[string]bool) error {
+	if set["s"] && set["c"] {
+		return errors.New("-s and -c cannot be used together")
+	}
+	if set["s"] || set["c"] {
+		if len(c.Servers) == 0 {
+			c.Servers = append(c.Servers, serverConfig{})
+		}
+		c.Role = "server"
+		c.Servers[0].Address = flags.Server
+		if set["c"] {
+			c.Role = "client"
+			c.Servers[0].Address = flags.Client
+		}
+	}
+	s := &serverConfig{Method: c.Method, Password: c.Password, Key: c.Key, Plugin: c.Plugin, PluginOpts: c.PluginOpts, Mode: c.Mode, Users: c.Users, Timestamp: c.Timestamp}
+	if len(c.Servers) > 0 {
+		s = &c.Servers[0]
+	}
+	if set["cipher"] {
+		s.Method = flags.Cipher
+	}
+	if set["password"] {
+		s.Password = flags.Password
+	}
+	if set["key"] {
+		s.Key = flags.Key
+	}
+	if set["plugin"] {
+		s.Plugin = flags.Plugin
+	}
+	if set["plugin-opts"] {
+		s.PluginOpts = flags.PluginOpts
+	}
+	if set["users"] {
+		s.Users = flags.Users
+	}
+	if set["timestamp"] {
+		s.Timestamp = flags.Timestamp
+	}
+	if set["tcp"] || set["udp"] {
+		tcp, udp := hasTCP(s.Mode), hasUDP(s.Mode)
+		if set["tcp"] {
+			tcp = flags.TCP
+		}
+		if set["udp"] {
+			udp = flags.UDP
+		}
+		if !tcp && !udp {
+			return errors.New("neither TCP nor UDP is enabled")
+		}
+		s.Mode = makeMode(tcp, udp)
+	}
+	if len(c.Servers) == 0 {
+		c.Method, c.Password, c.Key, c.Plugin, c.PluginOpts, c.Mode, c.Users, c.Timestamp = s.Method, s.Password, s.Key, s.Plugin, s.PluginOpts, s.Mode, s.Users, s.Timestamp
+	}
+	if set["manager-address"] {
+		c.Manager = flags.ManagerAddress
+		if c.Role == "" {
+			c.Role = "server"
+		}
+	}
+
+	for typ, addr := range map[string]string{"socks": flags.Socks, "http": flags.HTTP, "mixed": flags.Mixed, "redir": flags.RedirTCP, "redir6": flags.RedirTCP6} {
+		if set[typ] {
+			c.setListener(typ, addr)
+		}
+	}
+	if set["u"] {
+		for i := range c.Listeners {
+			if t := c.Listeners[i].Type; t == "socks" || t == "mixed" {
+				c.Listeners[i].UDP = flags.UDPSocks
+			}
+		}
+	}
+	if set["auth"] {
+		for i := range c.Listeners {
+			if t := c.Listeners[i].Type; t == "socks" || t == "http" || t == "mixed" {
+				c.Listeners[i].Auth = flags.Auth
+			}
+		}
+	}
+
+	if set["tcptun"] || set["udptun"] {
+		c.Tunnels = nil
+		for _, t := range []struct{ list, mode string }{{flags.TCPTun, modeTCPOnly}, {flags.UDPTun, modeUDPOnly}} {
+			if t.list == "" {
+				continue
+			}
+			for _, tun := range strings.Split(t.list, ",") {
+				local, remote, ok := strings.Cut(tun, "=")
+				if !ok {
+					return fmt.Errorf("tunnel %q: want laddr=raddr", tun)
+				}
+				c.Tunnels = append(c.Tunnels, tunnelConfig{Local: local, Remote: remote, Mode: t.mode})
+			}
+		}
+	}
+
+	if set["outbound-allow"] || set["outbound-deny"] {
+		if c.Outbound == nil {
+			c.Outbound = new(outboundConfig)
+		}
+		if set["outbound-allow"] {
+			c.Outbound.Allow = strings.Split(flags.OutboundAllow, ",")
+		}
+		if set["outbound-deny"] {
+			c.Outbound.Deny = strings.Split(flags.OutboundDeny, ",")
+		}
+	}
+	if set["inbound-allow"] || set["inbound-deny"] || set["max-conns-per-ip"] || set["max-conns"] {
+		if c.Inbound == nil {
+			c.Inbound = new(inboundConfig)
+		}
+		if set["inbound-allow"] {
+			c.Inbound.Allow = strings.Split(flags.InboundAllow, ",")
+		}
+		if set["inbound-deny"] {
+			c.Inbound.Deny = strings.Split(flags.InboundDeny, ",")
+		}
+		if set["max-conns-per-ip"] {
+			c.Inbound.MaxConnsPerIP = flags.MaxConnsPerIP
+		}
+		if set["max-conns"] {
+			c.Inbound.MaxConns = flags.MaxConns
+		}
+	}
+	if set["metrics"] {
+		c.Metrics = flags.Metrics
+	}
+	if set["verbose"] {
+		c.Verbose = config.Verbose
+	}
+	if set["loglevel"] {
+		c.LogLevel = flags.LogLevel
+	}
+	if set["logformat"] {
+		c.LogFormat = flags.LogFormat
+	}
+	if set["accesslog"] {
+		c.AccessLog = flags.AccessLog
+	}
+	if set["tcpcork"] {
+		c.TCPCork = config.TCPCork
+	}
+	if set["deferreply"] {
+		c.DeferReply = config.DeferReply
+	}
+	if set["udptimeout"] {
+		if c.Idle == nil { // the TCP idle timeout stays that of the file
+			d := c.Timeout
+			c.Idle = &d
+		}
+		c.Timeout = seconds(config.UDPTimeout)
+	}
+	if set["shutdowntimeout"] {
+		d := seconds(config.ShutdownTimeout)
+		c.Shutdown = &d
+	}
+	if set["handshaketimeout"] {
+		d := seconds(config.HandshakeTimeout)
+		c.Handshake = &d
+	}
+	if set["idletimeout"] {
+		d := seconds(config.IdleTimeout)
+		c.Idle = &d
+	}
+	if set["halfclosetimeout"] {
+		d := seconds(config.HalfCloseTimeout)
+		c.HalfClose = &d
+	}
+	if set["trafficlog"] {
+		c.TrafficLog = seconds(config.TrafficLog)
+	}
+	if set["fallback"] {
+		c.Fallback = flags.Fallback
+	}
+	if set["quotafile"] {
+		c.QuotaFile = flags.QuotaFile
+	}
+	if set["saltfile"] {
+		c.SaltFile = flags.SaltFile
+	}
+	return nil
+}
+
+// setListener replaces the listeners of typ with one on addr.
+func (c *fileConfig) setListener(typ, addr string) {
+	var ls []listenerConfig
+	for _, l := range c.Listeners {
+		if l.Type != typ {
+			ls = append(ls, l)
+		}
+	}
+	c.Listeners = append(ls, listenerConfig{Type: typ, Address: addr})
+}
+
+// resolve validates c and picks the ciphers of its servers.
+func (c *fileConfig) resolve() error {
+	if c.Role != "server" && c.Role != "client" {
+		return fmt.Errorf("role %q: want server or client", c.Role)
+	}
+	if c.Manager != "" && c.Role != "server" {
+		return errors.New("the manager is for servers")
+	}
+	if c.Outbound != nil && c.Role != "server" {
+		return errors.New("outbound is for servers")
+	}
+	acl, err := c.Outbound.acl()
+	if err != nil {
+		return fmt.Errorf("outbound: %v", err)
+	}
+	c.acl = acl
+	if c.Fallback != "" {
+		if c.Role != "server" {
+			return errors.New("fallback is for servers")
+		}
+		if _, _, err := net.SplitHostPort(c.Fallback); err != nil {
+			return fmt.Errorf("fallback: %v", err)
+		}
+	}
+	if c.Inbound != nil && c.Role != "server" {
+		return errors.New("inbound is for servers")
+	}
+	policy, err := c.Inbound.policy()
+	if err != nil {
+		return fmt.Errorf("inbound: %v", err)
+	}
+	c.policy = policy
+	if len(c.Servers) == 0 && c.Manager == "" {
+		return errors.New("no server")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout %v: must not be negative", c.Timeout)
+	}
+	for _, t := range []struct {
+		name string
+		v    *seconds
+	}{{"shutdown_timeout", c.Shutdown}, {"handshake_timeout", c.Handshake}, {"idle_timeout", c.Idle}, {"half_close_timeout", c.HalfClose}} {
+		if t.v != nil && *t.v < 0 {
+			return fmt.Errorf("%s %v: must not be negative", t.name, *t.v)
+		}
+	}
+	if c.LogLevel != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return fmt.Errorf("log_level %q: want debug, info, warn or error", c.LogLevel)
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format %q: want text or json", c.LogFormat)
+	}
+	if c.TrafficLog < 0 {
+		return fmt.Errorf("traffic_log %v: must not be negative", c.TrafficLog)
+	}
+	if c.QuotaFile != "" && c.Role != "server" {
+		return errors.New("quota_file is for servers")
+	}
+	if c.RateLimit != nil && c.Role != "server" {
+		return errors.New("rate_limit is for servers")
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+	if err := c.SaltFilter.validate(); err != nil {
+		return fmt.Errorf("salt_filter: %v", err)
+	}
+
+	names := make(map[string]*serverConfig)
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		if s.SaltFilter == nil {
+			s.SaltFilter = c.SaltFilter
+		}
+		if err := s.resolve(c.Role == "server"); err != nil {
+			return fmt.Errorf("servers[%d]: %v", i, err)
+		}
+		if names[s.Name] != nil {
+			return fmt.Errorf("servers[%d]: duplicate name %s", i, s.Name)
+		}
+		names[s.Name] = s
+	}
+	server := func(name string) (*serverConfig, error) {
+		if name == "" {
+			return &c.Servers[0], nil
+		}
+		if s := names[name]; s != nil {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown server %s", name)
+	}
+
+	if c.Role == "server" {
+		if len(c.Listeners) > 0 || len(c.Tunnels) > 0 {
+			return errors.New("listeners and tunnels are for clients")
+		}
+		return nil
+	}
+	if len(c.Listeners) == 0 && len(c.Tunnels) == 0 {
+		return errors.New("no listener or tunnel")
+	}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		switch l.Type {
+		case "socks", "http", "mixed", "redir", "redir6":
+		default:
+			return fmt.Errorf("listeners[%d]: type %q: want socks, http, mixed, redir or redir6", i, l.Type)
+		}
+		if l.Address == "" {
+			return fmt.Errorf("listeners[%d]: missing address", i)
+		}
+		if l.Auth != "" {
+			if l.Type != "socks" && l.Type != "http" && l.Type != "mixed" {
+				return fmt.Errorf("listeners[%d]: auth is for socks, http and mixed listeners", i)
+			}
+			creds, err := loadCredentials(l.Auth)
+			if err != nil {
+				return fmt.Errorf("listeners[%d]: auth: %v", i, err)
+			}
+			l.creds = creds
+		}
+		s, err := server(l.Server)
+		if err != nil {
+			return fmt.Errorf("listeners[%d]: %v", i, err)
+		}
+		l.srv = s
+	}
+	for i := range c.Tunnels {
+		t := &c.Tunnels[i]
+		if t.Local == "" {
+			return fmt.Errorf("tunnels[%d]: missing local address", i)
+		}
+		if socks.ParseAddr(t.Remote) == nil {
+			return fmt.Errorf("tunnels[%d]: invalid remote address %q", i, t.Remote)
+		}
+		if t.Mode == "" {
+			t.Mode = modeTCPOnly
+		}
+		if !validMode(t.Mode) {
+			return fmt.Errorf("tunnels[%d]: mode %q: want %s, %s or %s", i, t.Mode, modeTCPOnly, modeUDPOnly, modeTCPAndUDP)
+		}
+		s, err := server(t.Server)
+		if err != nil {
+			return fmt.Errorf("tunnels[%d]: %v", i, err)
+		}
+		t.srv = s
+	}
+	return nil
+}
+
+func (s *serverConfig) resolve(server bool) error {
+	if strings.HasPrefix(s.Address, "ss://") {
+		addr, cipher, password, err := parseURL(s.Address)
+		if err != nil {
+			return err
+		}
+		s.Address = addr
+		if cipher != "" {
+			s.Method = cipher
+		}
+		if password != "" {
+			s.Password = password
+		}
+	}
+	if s.Address == "" {
+		return errors.New("missing address")
+	}
+	if _, port, err := net.SplitHostPort(s.Address); err != nil {
+		return err
+	} else if port == "" || port == "0" {
+		return fmt.Errorf("address %s: missing port", s.Address)
+	}
+	if s.Name == "" {
+		s.Name = s.Address
+	}
+	if s.Method == "" {
+		s.Method = defaultCipher
+	}
+	if s.Mode == "" {
+		s.Mode = modeTCPOnly
+	}
+	if !validMode(s.Mode) {
+		return fmt.Errorf("mode %q: want %s, %s or %s", s.Mode, modeTCPOnly, modeUDPOnly, modeTCPAndUDP)
+	}
+	if s.Password == "" && s.Key == "" {
+		s.Password = os.Getenv("SS_PASSWORD")
+	}
+
+	var key []byte
+	if s.Key != "" {
+		k, err := base64.URLEncoding.DecodeString(s.Key)
+		if err != nil {
+			return fmt.Errorf("key: %v", err)
+		}
+		key = k
+	}
+	ciph, err := core.PickCipher(s.Method, key, s.Password)
+	if err != nil {
+		return fmt.Errorf("method %s: %v", s.Method, err)
+	}
+	if s.Timestamp {
+		if ciph, err = core.TimestampCipher(ciph); err != nil {
+			return fmt.Errorf("timestamp: method %s: %v", s.Method, err)
+		}
+	}
+
+	if !server {
+		if s.Users != "" {
+			return errors.New("users are for servers")
+		}
+		if s.RateLimit != nil {
+			return errors.New("rate_limit is for servers")
+		}
+		if ciph, err = s.withSaltFilter(ciph, "", 1); err != nil {
+			return err
+		}
+		s.ciph = ciph
+		return nil
+	}
+	if err := s.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+	ciph = core.ServerCipher(ciph)
+	if s.Users != "" {
+		users, ucs, err := loadUsers(s.Users, s.Method)
+		if err != nil {
+			return err
+		}
+		s.userConfigs = ucs
+		for i, u := range users {
+			if s.Timestamp {
+				if u.Cipher, err = core.TimestampCipher(u.Cipher); err != nil {
+					return fmt.Errorf("timestamp: user %s: %v", u.Name, err)
+				}
+			}
+			if users[i].Cipher, err = s.withSaltFilter(u.Cipher, u.Name, len(users)); err != nil {
+				return fmt.Errorf("user %s: %v", u.Name, err)
+			}
+		}
+		if ciph, err = core.MultiUserCipher(ciph, users); err != nil {
+			return fmt.Errorf("users: %v", err)
+		}
+	} else if ciph, err = s.withSaltFilter(ciph, "", 1); err != nil {
+		return err
+	}
+	s.ciph = ciph
+	return nil
+}
+
+// setGlobals sets the settings of c which apply to the whole process. They
+// are only read at startup.
+func (c *fileConfig) setGlobals() {
+	config.Verbose = c.Verbose
+	config.TCPCork = c.TCPCork
+	config.DeferReply = c.DeferReply
+	if c.Timeout > 0 {
+		config.UDPTimeout = time.Duration(c.Timeout)
+		config.IdleTimeout = time.Duration(c.Timeout)
+	}
+	if c.Shutdown != nil {
+		config.ShutdownTimeout = time.Duration(*c.Shutdown)
+	}
+	if c.Handshake != nil {
+		config.HandshakeTimeout = time.Duration(*c.Handshake)
+	}
+	if c.Idle != nil {
+		config.IdleTimeout = time.Duration(*c.Idle)
+	}
+	if c.HalfClose != nil {
+		config.HalfCloseTimeout = time.Duration(*c.HalfClose)
+	}
+	config.TrafficLog = time.Duration(c.TrafficLog)
+	config.QuotaFile = c.QuotaFile
+	config.SaltFile = c.SaltFile
+}
+
+func validMode(mode string) bool {
+	return mode == modeTCPOnly || mode == modeUDPOnly || mode == modeTCPAndUDP
+}
+
+func hasTCP(mode string) bool { return mode == "" || mode == modeTCPOnly || mode == modeTCPAndUDP }
+func hasUDP(mode string) bool { return mode == modeUDPOnly || mode == modeTCPAndUDP }
+
+func makeMode(tcp, udp bool) string {
+	switch {
+	case tcp && udp:
+		return modeTCPAndUDP
+	case udp:
+		return modeUDPOnly
+	}
+	return modeTCPOnly
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSaltFilters drops the salt filters that resolving configurations
+// creates at the end of the test.
+func withSaltFilters(t *testing.T) {
+	saltFilters.Lock()
+	saved := saltFilters.entries
+	saltFilters.entries = nil
+	saltFilters.Unlock()
+	t.Cleanup(func() {
+		saltFilters.Lock()
+		saltFilters.entries = saved
+		saltFilters.Unlock()
+	})
+}
+
+// writeConfig writes the configuration file s, returning its path.
+func writeConfig(t *testing.T, s string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	withSaltFilters(t)
+	for _, tt := range []struct {
+		file      string
+		role      string
+		servers   []string // address, method and mode of each
+		listeners []string // type, address and server of each
+		tunnels   []string // local, remote and server of each
+		timeout   time.Duration
+		handshake time.Duration
+	}{
+		{
+			file:    "libev-server.json",
+			role:    "server",
+			servers: []string{"0.0.0.0:8488 aes-256-gcm tcp_and_udp", "[::]:8488 aes-256-gcm tcp_and_udp"},
+			timeout: 300 * time.Second,
+		},
+		{
+			file:      "libev-client.json",
+			role:      "client",
+			servers:   []string{"198.51.100.1:8488 chacha20-ietf-poly1305 tcp_and_udp"},
+			listeners: []string{"socks 127.0.0.1:1080 udp 198.51.100.1:8488"},
+			timeout:   time.Minute,
+		},
+		{
+			file:      "client.json",
+			role:      "client",
+			servers:   []string{"198.51.100.1:8488 aes-128-gcm tcp_only", "203.0.113.1:8388 chacha20-ietf-poly1305 tcp_only"},
+			listeners: []string{"mixed 127.0.0.1:1080 198.51.100.1:8488", "http 127.0.0.1:8080 203.0.113.1:8388"},
+			tunnels:   []string{"127.0.0.1:5353 192.0.2.53:53 udp_only 203.0.113.1:8388"},
+			handshake: 1500 * time.Millisecond,
+		},
+		{
+			file: "manager.json",
+			role: "server",
+		},
+	} {
+		c, err := loadConfig(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.resolve(); err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if c.Role != tt.role {
+			t.Errorf("%s: role %s, want %s", tt.file, c.Role, tt.role)
+		}
+		var servers, listeners, tunnels []string
+		for _, s := range c.Servers {
+			servers = append(servers, s.Address+" "+s.Method+" "+s.Mode)
+			if s.ciph == nil {
+				t.Errorf("%s: server %s without a cipher", tt.file, s.Address)
+			}
+		}
+		for _, l := range c.Listeners {
+			s := l.Type + " " + l.Address
+			if l.UDP {
+				s += " udp"
+			}
+			s += " " + l.srv.Address
+			listeners = append(listeners, s)
+		}
+		for _, tun := range c.Tunnels {
+			tunnels = append(tunnels, tun.Local+" "+tun.Remote+" "+tun.Mode+" "+tun.srv.Address)
+		}
+		for _, l := range []struct {
+			name      string
+			got, want []string
+		}{{"servers", servers, tt.servers}, {"listeners", listeners, tt.listeners}, {"tunnels", tunnels, tt.tunnels}} {
+			if strings.Join(l.got, ", ") != strings.Join(l.want, ", ") {
+				t.Errorf("%s: %s %q, want %q", tt.file, l.name, l.got, l.want)
+			}
+		}
+		if time.Duration(c.Timeout) != tt.timeout {
+			t.Errorf("%s: timeout %v, want %v", tt.file, c.Timeout, tt.timeout)
+		}
+		if c.Handshake != nil && time.Duration(*c.Handshake) != tt.handshake || c.Handshake == nil && tt.handshake != 0 {
+			t.Errorf("%s: handshake timeout %v, want %v", tt.file, c.Handshake, tt.handshake)
+		}
+	}
+}
+
+func TestApplyFlags(t *testing.T) {
+	withSaltFilters(t)
+	saved := flags
+	t.Cleanup(func() { flags = saved })
+	for _, tt := range []struct {
+		name      string
+		file      string // in testdata, if not empty
+		set       func()
+		flags     []string
+		role      string
+		server    string // address, method and mode of the first server
+		listeners string // types and addresses
+		err       string
+	}{
+		{
+			name:   "server flags",
+			set:    func() { flags.Server, flags.Cipher, flags.Password = ":8488", "aes-128-gcm", "secret" },
+			flags:  []string{"s", "cipher", "password"},
+			role:   "server",
+			server: ":8488 aes-128-gcm tcp_only",
+		},
+		{
+			name: "client flags",
+			set: func() {
+				flags.Client, flags.Password, flags.Socks = "ss://aes-256-gcm:secret@192.0.2.1:8488", "ignored", "127.0.0.1:1080"
+			},
+			flags:     []string{"c", "socks"},
+			role:      "client",
+			server:    "192.0.2.1:8488 aes-256-gcm tcp_only",
+			listeners: "socks 127.0.0.1:1080",
+		},
+		{
+			name:  "-s over the file",
+			file:  "libev-client.json",
+			set:   func() { flags.Server = ":9000" },
+			flags: []string{"s"},
+			err:   "listeners and tunnels are for clients",
+		},
+		{
+			name:   "cipher and mode over the file",
+			file:   "libev-server.json",
+			set:    func() { flags.Cipher, flags.UDP = "aes-128-gcm", false },
+			flags:  []string{"cipher", "udp"},
+			role:   "server",
+			server: "0.0.0.0:8488 aes-128-gcm tcp_only",
+		},
+		{
+			name:      "listeners over the file",
+			file:      "client.json",
+			set:       func() { flags.HTTP = "127.0.0.1:3128" },
+			flags:     []string{"http"},
+			role:      "client",
+			server:    "198.51.100.1:8488 aes-128-gcm tcp_only",
+			listeners: "mixed 127.0.0.1:1080, http 127.0.0.1:3128",
+		},
+		{
+			name:  "manager flag",
+			set:   func() { flags.ManagerAddress = "127.0.0.1:6001" },
+			flags: []string{"manager-address"},
+			role:  "server",
+		},
+		{
+			name:  "-s and -c",
+			set:   func() { flags.Server, flags.Client = ":8488", "192.0.2.1:8488" },
+			flags: []string{"s", "c"},
+			err:   "-s and -c cannot be used together",
+		},
+		{
+			name:  "neither TCP nor UDP",
+			file:  "libev-server.json",
+			set:   func() { flags.TCP, flags.UDP = false, false },
+			flags: []string{"tcp", "udp"},
+			err:   "neither TCP nor UDP is enabled",
+		},
+		{
+			name:  "bad tunnel",
+			file:  "client.json",
+			set:   func() { flags.TCPTun = "127.0.0.1:8053" },
+			flags: []string{"tcptun"},
+			err:   "want laddr=raddr",
+		},
+	} {
+		flags = saved
+		tt.set()
+		if tt.file != "" {
+			flags.Config = filepath.Join("testdata", tt.file)
+		}
+		set := make(map[string]bool)
+		for _, f := range tt.flags {
+			set[f] = true
+		}
+		c, err := readConfig(set)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if c.Role != tt.role {
+			t.Errorf("%s: role %s, want %s", tt.name, c.Role, tt.role)
+		}
+		if tt.server != "" {
+			if s := c.Servers[0]; s.Address+" "+s.Method+" "+s.Mode != tt.server {
+				t.Errorf("%s: server %s %s %s, want %s", tt.name, s.Address, s.Method, s.Mode, tt.server)
+			}
+		}
+		var listeners []string
+		for _, l := range c.Listeners {
+			listeners = append(listeners, l.Type+" "+l.Address)
+		}
+		if got := strings.Join(listeners, ", "); got != tt.listeners {
+			t.Errorf("%s: listeners %q, want %q", tt.name, got, tt.listeners)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	withSaltFilters(t)
+	const server = `"server_port": 8488, "password": "secret"`
+	const client = `"server": "192.0.2.1", "server_port": 8488, "password": "secret", "local_port": 1080`
+	for _, tt := range []struct {
+		config string
+		err    string
+	}{
+		{`{"server_port": 8488, "timeout": "300"}`, "invalid number of seconds"},
+		{`{"server": 1}`, "cannot unmarshal"},
+		{`{"role": "relay", ` + server + `}`, `role "relay"`},
+		{`{}`, "no server"},
+		{`{"role": "client", ` + server + `}`, "no listener or tunnel"},
+		{`{` + server + `, "method": "rot13"}`, "method rot13"},
+		{`{` + server + `, "mode": "sctp_only"}`, `mode "sctp_only"`},
+		{`{` + server + `, "idle_timeout": -1}`, "idle_timeout -1s: must not be negative"},
+		{`{` + server + `, "log_level": "loud"}`, `log_level "loud"`},
+		{`{` + server + `, "log_format": "xml"}`, `log_format "xml"`},
+		{`{` + server + `, "rate_limit": {"up": -1}}`, "rate_limit: rates must not be negative"},
+		{`{` + server + `, "salt_filter": {"fpr": 2}}`, "salt_filter"},
+		{`{` + server + `, "fallback": "127.0.0.1"}`, "fallback"},
+		{`{` + server + `, "inbound": {"allow": ["not an address"]}}`, "inbound"},
+		{`{"servers": [{"address": ":8488"}, {"address": "[::]:8488", "name": ":8488"}], "password": "secret"}`, "servers[1]: duplicate name :8488"},
+		{`{"servers": [{"address": "192.0.2.1"}]}`, "servers[0]"},
+		{`{` + client + `, "rate_limit": {"up": 1000}}`, "rate_limit is for servers"},
+		{`{` + client + `, "users": "users.json"}`, "servers[0]: users are for servers"},
+		{`{` + client + `, "fallback": "127.0.0.1:80"}`, "fallback is for servers"},
+		{`{` + client + `, "manager_address": "127.0.0.1:6001"}`, "the manager is for servers"},
+		{`{` + client + `, "listeners": [{"type": "ftp", "address": ":21"}]}`, `listeners[1]: type "ftp"`},
+		{`{` + client + `, "listeners": [{"type": "redir", "address": ":1081", "auth": "auth.json"}]}`, "listeners[1]: auth is for socks"},
+		{`{` + client + `, "listeners": [{"type": "http", "address": ":8080", "server": "far"}]}`, "listeners[1]: unknown server far"},
+		{`{` + client + `, "tunnels": [{"local": ":53", "remote": "dns"}]}`, `tunnels[0]: invalid remote address "dns"`},
+	} {
+		c, err := loadConfig(writeConfig(t, tt.config))
+		if err == nil {
+			err = c.resolve()
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
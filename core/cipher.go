@@ -2,8 +2,10 @@ package core
 
 import (
 	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"net"
+	"net/netip"
 	"sort"
 	"strings"
 
@@ -30,6 +32,10 @@ const (
 	aeadAes128Gcm        = "AEAD_AES_128_GCM"
 	aeadAes256Gcm        = "AEAD_AES_256_GCM"
 	aeadChacha20Poly1305 = "AEAD_CHACHA20_POLY1305"
+
+	blake3Aes128Gcm        = "2022-BLAKE3-AES-128-GCM"
+	blake3Aes256Gcm        = "2022-BLAKE3-AES-256-GCM"
+	blake3Chacha20Poly1305 = "2022-BLAKE3-CHACHA20-POLY1305"
 )
 
 // List of AEAD ciphers: key size in bytes and constructor
@@ -42,17 +48,32 @@ var aeadList = map[string]struct {
 	aeadChacha20Poly1305: {32, shadowaead.Chacha20Poly1305},
 }
 
+// List of SIP022 AEAD ciphers: key size in bytes and constructor
+var aead2022List = map[string]struct {
+	KeySize int
+	New     func([]byte) (shadowaead.Cipher2022, error)
+}{
+	blake3Aes128Gcm:        {16, shadowaead.Blake3AESGCM},
+	blake3Aes256Gcm:        {32, shadowaead.Blake3AESGCM},
+	blake3Chacha20Poly1305: {32, shadowaead.Blake3Chacha20Poly1305},
+}
+
 // ListCipher returns a list of available cipher names sorted alphabetically.
 func ListCipher() []string {
 	var l []string
 	for k := range aeadList {
 		l = append(l, k)
 	}
+	for k := range aead2022List {
+		l = append(l, k)
+	}
 	sort.Strings(l)
 	return l
 }
 
 // PickCipher returns a Cipher of the given name. Derive key from password if given key is empty.
+// SIP022 ciphers take the base64-encoded key as password instead. The Cipher returned is for the
+// client side; use ServerCipher to get the server side.
 func PickCipher(name string, key []byte, password string) (Cipher, error) {
 	name = strings.ToUpper(name)
 
@@ -78,14 +99,164 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 		return &aeadCipher{aead}, err
 	}
 
+	if choice, ok := aead2022List[name]; ok {
+		// identity PSKs of multi-user servers precede the user PSK: iPSK1:iPSK2:uPSK
+		var ipsks [][]byte
+		if len(key) == 0 {
+			psks := strings.Split(password, ":")
+			for _, p := range psks {
+				k, err := base64.StdEncoding.DecodeString(p)
+				if err != nil {
+					return nil, err
+				}
+				if len(k) != choice.KeySize {
+					return nil, shadowaead.KeySizeError(choice.KeySize)
+				}
+				ipsks = append(ipsks, k)
+			}
+			key, ipsks = ipsks[len(ipsks)-1], ipsks[:len(ipsks)-1]
+		}
+		if len(key) != choice.KeySize {
+			return nil, shadowaead.KeySizeError(choice.KeySize)
+		}
+		aead, err := choice.New(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(ipsks) > 0 {
+			if aead, err = shadowaead.WithIdentities(aead, ipsks...); err != nil {
+				return nil, err
+			}
+		}
+		return &aead2022Cipher{Cipher2022: aead}, nil
+	}
+
+	return nil, ErrCipherNotSupported
+}
+
+// ServerCipher returns the server side of ciph. SIP022 ciphers format requests and responses
+// differently; other ciphers are symmetric and returned as is.
+func ServerCipher(ciph Cipher) Cipher {
+	if c, ok := ciph.(*aead2022Cipher); ok {
+		return &aead2022Cipher{Cipher2022: c.Cipher2022, server: true}
+	}
+	return ciph
+}
+
+// TimestampCipher returns ciph with the timestamp extension of shadowaead.WithTimestamp. Only
+// AEAD ciphers other than SIP022 ones, whose headers carry timestamps anyway, support it.
+func TimestampCipher(ciph Cipher) (Cipher, error) {
+	c, ok := ciph.(*aeadCipher)
+	if !ok {
+		return nil, ErrCipherNotSupported
+	}
+	return &aeadCipher{shadowaead.WithTimestamp(c.Cipher)}, nil
+}
+
+// SaltFilterCipher returns ciph recording its salts in f, which may be shared by ciphers of the
+// same key, or in none if f is nil. Only single-user AEAD ciphers support it; those of multi-user
+// servers use the filters of their users.
+func SaltFilterCipher(ciph Cipher, f *shadowaead.SaltFilter) (Cipher, error) {
+	switch c := ciph.(type) {
+	case *aeadCipher:
+		sc, err := shadowaead.WithSaltFilter(c.Cipher, f)
+		if err != nil {
+			return nil, err
+		}
+		return &aeadCipher{sc}, nil
+	case *aead2022Cipher:
+		sc, err := shadowaead.WithSaltFilter(c.Cipher2022, f)
+		if err != nil {
+			return nil, err
+		}
+		return &aead2022Cipher{Cipher2022: sc.(shadowaead.Cipher2022), server: c.server}, nil
+	}
 	return nil, ErrCipherNotSupported
 }
 
 type aeadCipher struct{ shadowaead.Cipher }
 
-func (aead *aeadCipher) StreamConn(c net.Conn) net.Conn { return shadowaead.NewConn(c, aead) }
+func (aead *aeadCipher) StreamConn(c net.Conn) net.Conn { return shadowaead.NewConn(c, aead.Cipher) }
 func (aead *aeadCipher) PacketConn(c net.PacketConn) net.PacketConn {
-	return shadowaead.NewPacketConn(c, aead)
+	return shadowaead.NewPacketConn(c, aead.Cipher)
+}
+
+// A User is a named user of a multi-user server.
+type User struct {
+	Name   string
+	Cipher Cipher
+}
+
+// UserConn is a net.Conn of a multi-user server.
+type UserConn interface {
+	net.Conn
+	// User returns the name of the user, known once the request has been read.
+	User() string
+}
+
+// UserPacketConn is a net.PacketConn of a multi-user server.
+type UserPacketConn interface {
+	net.PacketConn
+	// User returns the name of the user whose packets last came from addr.
+	User(addr netip.AddrPort) string
+}
+
+// MultiUserCipher returns the server side of a Cipher serving the given users on a single port.
+// Connections of the Cipher are UserConn and UserPacketConn. Users of SIP022 ciphers are told
+// apart by identity headers encrypted with ciph, the identity PSK of the server. Users of other
+// AEAD ciphers, who may each use a different cipher, are told apart by trial decryption with
+// their keys; ciph is not used for them.
+func MultiUserCipher(ciph Cipher, users []User) (Cipher, error) {
+	c, ok := ciph.(*aead2022Cipher)
+	if !ok {
+		var su []shadowaead.User
+		for _, u := range users {
+			uc, ok := u.Cipher.(*aeadCipher)
+			if !ok {
+				return nil, ErrCipherNotSupported
+			}
+			su = append(su, shadowaead.User{Name: u.Name, Cipher: uc.Cipher})
+		}
+		return &multiUserCipher{shadowaead.NewUserSet(su)}, nil
+	}
+	var su []shadowaead.User
+	for _, u := range users {
+		uc, ok := u.Cipher.(*aead2022Cipher)
+		if !ok {
+			return nil, ErrCipherNotSupported
+		}
+		su = append(su, shadowaead.User{Name: u.Name, Cipher: uc.Cipher2022})
+	}
+	aead, err := shadowaead.WithUsers(c.Cipher2022, su)
+	if err != nil {
+		return nil, err
+	}
+	return &aead2022Cipher{Cipher2022: aead, server: true}, nil
+}
+
+type multiUserCipher struct{ users *shadowaead.UserSet }
+
+func (m *multiUserCipher) StreamConn(c net.Conn) net.Conn { return shadowaead.NewUserConn(c, m.users) }
+func (m *multiUserCipher) PacketConn(c net.PacketConn) net.PacketConn {
+	return shadowaead.NewUserPacketConn(c, m.users)
+}
+
+type aead2022Cipher struct {
+	shadowaead.Cipher2022
+	server bool
+}
+
+func (aead *aead2022Cipher) StreamConn(c net.Conn) net.Conn {
+	if aead.server {
+		return shadowaead.NewServerConn2022(c, aead.Cipher2022)
+	}
+	return shadowaead.NewConn2022(c, aead.Cipher2022)
+}
+func (aead *aead2022Cipher) PacketConn(c net.PacketConn) net.PacketConn {
+	if aead.server {
+		return shadowaead.NewServerPacketConn2022(c, aead.Cipher2022)
+	}
+	return shadowaead.NewPacketConn2022(c, aead.Cipher2022)
 }
 
 // dummy cipher does not encrypt
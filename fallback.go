@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// fallback is the address of running servers to proxy clients failing to
+// authenticate to, if not empty, so that probes only see the decoy there.
+var fallback atomic.Pointer[string]
+
+// recordConn records what is read from a client until stopped, for the
+// fallback to get all of it.
+type recordConn struct {
+	net.Conn
+	buf     []byte
+	stopped bool
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stopped {
+		c.buf = append(c.buf, b[:n]...)
+	}
+	return n, err
+}
+
+func (c *recordConn) stop() {
+	c.stopped = true
+	c.buf = nil
+}
+
+// deflect hides the server from a client it does not serve on c. It proxies
+// c to the fallback, replaying what rec read; without a fallback, or if it
+// is unreachable, it drains c if drain is set, or closes it.
+func deflect(c net.Conn, rec *recordConn, rl *relayLog, drain bool) {
+	if addr := fallback.Load(); addr != nil && *addr != "" {
+		fc, err := net.Dial("tcp", *addr)
+		if err == nil {
+			defer fc.Close()
+			metrics.fallbacks.Add(1)
+			rl.Debug("proxy to fallback", "fallback", *addr)
+			if _, err = fc.Write(rec.buf); err == nil {
+				err = relay(c, fc)
+			}
+			if err != nil {
+				rl.Debug("fallback relay error", "err", err)
+			}
+			return
+		}
+		rl.Warn("failed to connect to fallback", "fallback", *addr, "err", err)
+	}
+	if drain {
+		drainConn(c, rl)
+	}
+}
+
+// drainConn reads c until the client closes it, to avoid leaking server
+// behavioral features.
+// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
+func drainConn(c net.Conn, rl *relayLog) {
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		rl.Debug("discard error", "err", err)
+	}
+}
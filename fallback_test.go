@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// decoy listens for connections to the fallback, sending what each of
+// them carried once closed.
+func decoy(t *testing.T) (addr string, got <-chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan []byte, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, _ := io.ReadAll(c)
+				ch <- b
+			}()
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+// capturedConn is a connection keeping what is written to it.
+type capturedConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *capturedConn) Write(b []byte) (int, error) {
+	c.buf.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestFallbackReplay(t *testing.T) {
+	saved := config
+	config.HandshakeTimeout, config.HalfCloseTimeout = 200*time.Millisecond, 0
+	addr, got := decoy(t)
+	fallback.Store(&addr)
+	t.Cleanup(func() {
+		config = saved
+		fallback.Store(nil)
+	})
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	server, _ := shadowaead.Chacha20Poly1305(key)
+	client, _ := shadowaead.Chacha20Poly1305(key)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tcpRemote(l, func(c net.Conn) net.Conn { return shadowaead.NewConn(c, server) })
+	t.Cleanup(func() {
+		l.Close()
+		conns.drain(time.Second)
+	})
+
+	dial := func() *net.TCPConn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c.(*net.TCPConn)
+	}
+
+	// a request that the server takes, to be replayed
+	cc := &capturedConn{Conn: dial()}
+	if _, err := shadowaead.NewConn(cc, client).Write(socks.ParseAddr("192.0.2.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	replayed := cc.buf.Bytes()
+
+	junk := make([]byte, 100)
+	rand.Read(junk)
+
+	for _, tt := range []struct {
+		name  string
+		first []byte
+		pause time.Duration // before the rest
+	}{
+		{"junk", junk, 0},
+		{"timed out", junk[:10], 400 * time.Millisecond},
+		{"replayed", replayed, 0},
+	} {
+		c := dial()
+		if _, err := c.Write(tt.first); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(tt.pause)
+		if _, err := c.Write([]byte("rest of the stream")); err != nil {
+			t.Fatal(err)
+		}
+		c.CloseWrite()
+
+		select {
+		case b := <-got:
+			if want := append(append([]byte(nil), tt.first...), "rest of the stream"...); !bytes.Equal(b, want) {
+				t.Fatalf("%s: fallback got %q, want %q", tt.name, b, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: connection not proxied to the fallback", tt.name)
+		}
+	}
+}
@@ -3,8 +3,11 @@ module github.com/shadowsocks/go-shadowsocks2
 go 1.23
 
 require (
-	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+	lukechampine.com/blake3 v1.4.1
 )
 
-require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+require (
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+)
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Create an HTTP proxy on l and proxy to server, authenticating clients with
+// the credentials of the listener from ps.
+func httpLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn, ps func() proxySettings) {
+	logger.Info("HTTP proxy", "local", l.Addr(), "server", server)
+	acceptLocal(l, func(c net.Conn) { serveHTTP(c, bufio.NewReader(c), server, shadow, ps().creds) })
+}
+
+// bufConn is a connection read through r, which may hold data read ahead.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// An httpUpstream is a stream through server to the target of plain HTTP
+// requests, kept for the next requests to the same target.
+type httpUpstream struct {
+	net.Conn
+	r      *bufio.Reader
+	target string
+	rl     *relayLog
+}
+
+func (u *httpUpstream) close(err error) {
+	u.Close()
+	u.rl.end(err)
+}
+
+// serveHTTP serves the HTTP proxy requests read from c through r, proxying
+// them to server: CONNECT requests are relayed as tunnels, and requests for
+// absolute http URIs are forwarded on a stream to their target, reused while
+// the next ones on c are for the same target and user. Unless creds is nil,
+// requests must carry the name and password of a user in Proxy-Authorization.
+func serveHTTP(c net.Conn, r *bufio.Reader, server string, shadow func(net.Conn) net.Conn, creds credentials) {
+	var up *httpUpstream
+	defer func() {
+		if up != nil {
+			up.close(nil)
+		}
+	}()
+
+	for first := true; ; first = false {
+		// the handshake timeout runs from the start of a request, not while
+		// a kept-alive client is idle between them
+		if !first {
+			if config.IdleTimeout > 0 {
+				c.SetReadDeadline(time.Now().Add(config.IdleTimeout))
+			}
+			if _, err := r.Peek(1); err != nil {
+				return
+			}
+		}
+		setHandshakeDeadline(c)
+		req, err := http.ReadRequest(r)
+		c.SetDeadline(time.Time{})
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("failed to read HTTP request", "client", c.RemoteAddr(), "err", err)
+			}
+			return
+		}
+
+		var user string
+		if creds != nil {
+			var password string
+			var ok bool
+			if user, password, ok = proxyBasicAuth(req); !ok || !creds.check(user, password) {
+				if ok {
+					logger.Info("authentication failed", "client", c.RemoteAddr(), "user", user)
+				}
+				httpError(c, http.StatusProxyAuthRequired)
+				return
+			}
+		}
+
+		if req.Method == http.MethodConnect {
+			if up != nil {
+				up.close(nil)
+				up = nil
+			}
+			httpConnect(c, r, req, user, server, shadow)
+			return
+		}
+
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			logger.Debug("not an HTTP proxy request", "client", c.RemoteAddr(), "uri", req.RequestURI)
+			httpError(c, http.StatusBadRequest)
+			return
+		}
+		target := req.URL.Host
+		if req.URL.Port() == "" {
+			target = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+		if up != nil && (up.target != target || up.rl.user != user) {
+			up.close(nil)
+			up = nil
+		}
+		if up == nil {
+			tgt := socks.ParseAddr(target)
+			if tgt == nil {
+				logger.Debug("invalid target address", "client", c.RemoteAddr(), "target", target)
+				httpError(c, http.StatusBadRequest)
+				return
+			}
+			rl := newRelayLog(c.RemoteAddr().String())
+			rl.setUser(user)
+			rl.target = tgt.String()
+			rc, err := connectServer(server, tgt, shadow, rl)
+			if err != nil {
+				httpError(c, http.StatusBadGateway)
+				return
+			}
+			rl.Debug("proxy", "client", c.RemoteAddr(), "server", server, "target", tgt)
+			up = &httpUpstream{rc, bufio.NewReader(rc), target, rl}
+		}
+
+		// the client waits for an interim response before sending the body
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			if _, err := io.WriteString(c, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+				return
+			}
+		}
+		keepAlive := !req.Close
+		removeHopHeaders(req.Header)
+		req.Close = false
+		if err := req.Write(up); err != nil {
+			up.rl.Debug("failed to forward HTTP request", "err", err)
+			up.close(err)
+			up = nil
+			httpError(c, http.StatusBadGateway)
+			return
+		}
+
+		resp, err := http.ReadResponse(up.r, req)
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if err = resp.Write(c); err == nil {
+				resp, err = http.ReadResponse(up.r, req)
+			}
+		}
+		if err != nil {
+			up.rl.Debug("failed to read HTTP response", "err", err)
+			up.close(err)
+			up = nil
+			httpError(c, http.StatusBadGateway)
+			return
+		}
+		reuse := !resp.Close
+		removeHopHeaders(resp.Header)
+		// a body without length ends when the connection closes
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.Body != http.NoBody {
+			keepAlive = false
+		}
+		resp.Close = !keepAlive
+		err = resp.Write(c)
+		resp.Body.Close()
+		if err != nil {
+			up.rl.Debug("failed to relay HTTP response", "err", err)
+			return
+		}
+		if !reuse {
+			up.close(nil)
+			up = nil
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// httpConnect relays c, read through r, as a tunnel to the target of the
+// CONNECT request req of user through server.
+func httpConnect(c net.Conn, r *bufio.Reader, req *http.Request, user, server string, shadow func(net.Conn) net.Conn) {
+	rl := newRelayLog(c.RemoteAddr().String())
+	rl.setUser(user)
+	tgt := socks.ParseAddr(req.Host)
+	if tgt == nil {
+		rl.Debug("invalid target address", "target", req.Host)
+		httpError(c, http.StatusBadRequest)
+		return
+	}
+	rl.target = tgt.String()
+
+	rc, err := connectServer(server, tgt, shadow, rl)
+	if err != nil {
+		httpError(c, http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		rl.end(err)
+		return
+	}
+
+	rl.Debug("proxy", "client", c.RemoteAddr(), "server", server, "target", tgt)
+	err = relay(rc, &bufConn{c, r})
+	if err != nil {
+		rl.Debug("relay error", "err", err)
+	}
+	rl.end(err)
+}
+
+// httpError replies to the request on c with code, closing the connection.
+func httpError(c net.Conn, code int) {
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Close:      true,
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+	}
+	if code == http.StatusProxyAuthRequired {
+		resp.Header.Set("Proxy-Authenticate", `Basic realm="shadowsocks"`)
+	}
+	text := http.StatusText(code) + "\n"
+	resp.ContentLength = int64(len(text))
+	resp.Body = io.NopCloser(strings.NewReader(text))
+	resp.Write(c)
+}
+
+// proxyBasicAuth returns the name and password of the Basic authentication
+// in the Proxy-Authorization header of req, if any.
+func proxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	scheme, cred, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// hopHeaders are the headers of a connection, which proxies do not forward.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including those
+// listed in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// plainServer is a server of streams in the clear, recording the target
+// asked for by each.
+type plainServer struct {
+	net.Listener
+	mu      sync.Mutex
+	targets []string
+}
+
+func newPlainServer(t *testing.T) *plainServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &plainServer{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				tgt, err := socks.ReadAddr(c)
+				if err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.targets = append(s.targets, tgt.String())
+				s.mu.Unlock()
+				rc, err := net.Dial("tcp", tgt.String())
+				if err != nil {
+					return
+				}
+				defer rc.Close()
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *plainServer) streams() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+// httpProxy returns a connection to an HTTP proxy through s.
+func httpProxy(t *testing.T, s *plainServer) (net.Conn, *bufio.Reader) {
+	client, c := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		serveHTTP(c, bufio.NewReader(c), s.Addr().String(), func(c net.Conn) net.Conn { return c }, nil)
+	}()
+	t.Cleanup(func() { client.Close(); <-done })
+	return client, bufio.NewReader(client)
+}
+
+// echoHeaders is a handler replying with the path and headers of requests.
+var echoHeaders = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s %s\n", r.Method, r.RequestURI)
+	r.Header.Write(w)
+})
+
+// roundTripHTTP writes req to c and returns the status and body of the
+// response read from r.
+func roundTripHTTP(t *testing.T, c net.Conn, r *bufio.Reader, req string) (int, string) {
+	if _, err := io.WriteString(c, req); err != nil {
+		t.Fatalf("Write request: %v", err)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Read response: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Read body: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestHTTPForward(t *testing.T) {
+	backend := httptest.NewServer(echoHeaders)
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	s := newPlainServer(t)
+	c, r := httpProxy(t, s)
+
+	code, body := roundTripHTTP(t, c, r, "GET "+backend.URL+"/path?q=1 HTTP/1.1\r\nHost: "+host+"\r\nX-End: 1\r\n\r\n")
+	if code != http.StatusOK || !strings.HasPrefix(body, "GET /path?q=1\n") {
+		t.Fatalf("Forwarded request got %d %q", code, body)
+	}
+	if !strings.Contains(body, "X-End: 1") {
+		t.Fatalf("End-to-end header not forwarded: %q", body)
+	}
+	if got := s.streams(); len(got) != 1 || got[0] != host {
+		t.Fatalf("Streams to %q, want one to %s", got, host)
+	}
+}
+
+func TestHTTPHopHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Resp-Hop")
+		w.Header().Set("X-Resp-Hop", "1")
+		w.Header().Set("X-Resp-End", "1")
+		echoHeaders(w, r)
+	}))
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	c, r := httpProxy(t, newPlainServer(t))
+
+	req := "GET " + backend.URL + "/ HTTP/1.1\r\nHost: " + host + "\r\n" +
+		"Connection: keep-alive, X-Hop\r\nX-Hop: 1\r\nKeep-Alive: timeout=5\r\n" +
+		"Proxy-Connection: keep-alive\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\nTe: trailers\r\n" +
+		"X-End: 1\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, h := range []string{"X-Hop", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te"} {
+		if strings.Contains(string(b), h+":") {
+			t.Errorf("Hop-by-hop header %s forwarded", h)
+		}
+	}
+	if !strings.Contains(string(b), "X-End: 1") {
+		t.Errorf("End-to-end header not forwarded: %q", b)
+	}
+	if resp.Header.Get("X-Resp-Hop") != "" || resp.Header.Get("X-Resp-End") != "1" {
+		t.Errorf("Response headers relayed: %v", resp.Header)
+	}
+}
+
+func TestHTTPKeepAlive(t *testing.T) {
+	saved := config
+	config.HandshakeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { config = saved })
+
+	backends := make([]string, 2)
+	for i := range backends {
+		b := httptest.NewServer(echoHeaders)
+		defer b.Close()
+		backends[i] = b.URL
+	}
+	s := newPlainServer(t)
+	c, r := httpProxy(t, s)
+
+	for i, u := range []string{backends[0], backends[0], backends[1], backends[0]} {
+		host := strings.TrimPrefix(u, "http://")
+		code, body := roundTripHTTP(t, c, r, "GET "+u+"/"+fmt.Sprint(i)+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		if code != http.StatusOK || !strings.HasPrefix(body, "GET /"+fmt.Sprint(i)+"\n") {
+			t.Fatalf("Request %d got %d %q", i, code, body)
+		}
+		// idle between requests past the handshake timeout
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// one stream per run of requests to the same target
+	want := []string{backends[0], backends[1], backends[0]}
+	got := s.streams()
+	if len(got) != len(want) {
+		t.Fatalf("Streams to %q, want to %q", got, want)
+	}
+	for i := range want {
+		if "http://"+got[i] != want[i] {
+			t.Fatalf("Streams to %q, want to %q", got, want)
+		}
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	backend := httptest.NewServer(echoHeaders)
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	s := newPlainServer(t)
+	c, r := httpProxy(t, s)
+
+	if _, err := io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %v, %v", resp, err)
+	}
+
+	// the tunnel carries requests as they are
+	code, body := roundTripHTTP(t, c, r, "GET /tunneled HTTP/1.1\r\nHost: "+host+"\r\nX-Hop: 1\r\nConnection: X-Hop\r\n\r\n")
+	if code != http.StatusOK || !strings.HasPrefix(body, "GET /tunneled\n") || !strings.Contains(body, "X-Hop: 1") {
+		t.Fatalf("Tunneled request got %d %q", code, body)
+	}
+	if got := s.streams(); len(got) != 1 || got[0] != host {
+		t.Fatalf("Streams to %q, want one to %s", got, host)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// inboundConfig restricts the clients servers accept, before decrypting
+// anything from them.
+type inboundConfig struct {
+	Allow         []string `json:"allow"` // CIDRs or IPs; all if empty
+	Deny          []string `json:"deny"`  // denied even if allowed
+	MaxConnsPerIP int      `json:"max_conns_per_ip"`
+	MaxConns      int      `json:"max_conns"`
+}
+
+// An inboundPolicy is an inboundConfig ready to check clients with.
+type inboundPolicy struct {
+	allow, deny   rules
+	perIP, global int // 0 for no limit
+}
+
+// inbound is the policy of running servers.
+var inbound atomic.Pointer[inboundPolicy]
+
+// Reasons for servers to reject clients.
+type rejectReason int
+
+const (
+	rejectDenied  rejectReason = iota + 1 // by the allow and deny lists
+	rejectIPLimit                         // too many connections from the IP
+	rejectLimit                           // too many connections in all
+	numRejectReasons
+)
+
+var rejectReasonNames = [numRejectReasons]string{"", "denied", "ip_limit", "limit"}
+
+// inboundConns counts the TCP connections and UDP sessions of clients.
+var inboundConns struct {
+	sync.Mutex
+	perIP map[netip.Addr]int
+	total int
+}
+
+func (c *inboundConfig) policy() (*inboundPolicy, error) {
+	p := new(inboundPolicy)
+	if c == nil {
+		return p, nil
+	}
+	var err error
+	if p.allow, err = parseRules(c.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %v", err)
+	}
+	if p.deny, err = parseRules(c.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %v", err)
+	}
+	if len(p.allow.domains) > 0 || len(p.deny.domains) > 0 {
+		return nil, errors.New("want CIDRs or IPs, not domains")
+	}
+	if c.MaxConnsPerIP < 0 || c.MaxConns < 0 {
+		return nil, errors.New("connection limits must not be negative")
+	}
+	p.perIP, p.global = c.MaxConnsPerIP, c.MaxConns
+	return p, nil
+}
+
+// admit checks a new connection or UDP session from ip. If admitted, it is
+// counted until done is called; otherwise reason tells why not.
+func admit(ip netip.Addr) (done func(), reason rejectReason) {
+	ip = ip.Unmap()
+	p := inbound.Load()
+	if p == nil {
+		p = new(inboundPolicy)
+	}
+	if p.deny.matchIP(ip) || len(p.allow.nets) > 0 && !p.allow.matchIP(ip) {
+		return nil, rejectDenied
+	}
+
+	inboundConns.Lock()
+	defer inboundConns.Unlock()
+	if inboundConns.perIP == nil {
+		inboundConns.perIP = make(map[netip.Addr]int)
+	}
+	if p.global > 0 && inboundConns.total >= p.global {
+		return nil, rejectLimit
+	}
+	if p.perIP > 0 && inboundConns.perIP[ip] >= p.perIP {
+		return nil, rejectIPLimit
+	}
+	inboundConns.total++
+	inboundConns.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inboundConns.Lock()
+			defer inboundConns.Unlock()
+			inboundConns.total--
+			if inboundConns.perIP[ip]--; inboundConns.perIP[ip] == 0 {
+				delete(inboundConns.perIP, ip)
+			}
+		})
+	}, 0
+}
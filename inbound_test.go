@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+// withInbound sets the inbound policy of the JSON config s for the rest of
+// the test, starting with no connections counted.
+func withInbound(t *testing.T, s string) {
+	var c inboundConfig
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := inbound.Swap(p)
+	inboundConns.Lock()
+	perIP, total := inboundConns.perIP, inboundConns.total
+	inboundConns.perIP, inboundConns.total = nil, 0
+	inboundConns.Unlock()
+	t.Cleanup(func() {
+		inbound.Store(saved)
+		inboundConns.Lock()
+		inboundConns.perIP, inboundConns.total = perIP, total
+		inboundConns.Unlock()
+	})
+}
+
+// counted returns the connections counted in all and from ip.
+func counted(ip string) (total, perIP int) {
+	inboundConns.Lock()
+	defer inboundConns.Unlock()
+	return inboundConns.total, inboundConns.perIP[netip.MustParseAddr(ip)]
+}
+
+func TestInboundAllowDeny(t *testing.T) {
+	withInbound(t, `{
+		"allow": ["10.0.0.0/8", "192.0.2.1", "fd00::/8"],
+		"deny": ["10.1.0.0/16", "fd00::1"]
+	}`)
+
+	for _, tt := range []struct {
+		ip   string
+		want rejectReason
+	}{
+		{"10.0.0.1", 0},
+		{"10.255.255.255", 0},
+		{"::ffff:10.0.0.1", 0},
+		{"192.0.2.1", 0},
+		{"192.0.2.2", rejectDenied},
+		{"10.1.2.3", rejectDenied},
+		{"::ffff:10.1.2.3", rejectDenied},
+		{"11.0.0.1", rejectDenied},
+		{"fd00::2", 0},
+		{"fd00::1", rejectDenied},
+		{"2001:db8::1", rejectDenied},
+	} {
+		done, reason := admit(netip.MustParseAddr(tt.ip))
+		if reason != tt.want {
+			t.Errorf("admit(%s) = %s, want %s", tt.ip, rejectReasonNames[reason], rejectReasonNames[tt.want])
+		}
+		if done != nil {
+			done()
+		}
+	}
+
+	// no allow list lets in all but the denied
+	withInbound(t, `{"deny": ["203.0.113.0/24"]}`)
+	for _, tt := range []struct {
+		ip   string
+		want rejectReason
+	}{
+		{"198.51.100.1", 0},
+		{"::1", 0},
+		{"203.0.113.9", rejectDenied},
+	} {
+		done, reason := admit(netip.MustParseAddr(tt.ip))
+		if reason != tt.want {
+			t.Errorf("admit(%s) = %s, want %s", tt.ip, rejectReasonNames[reason], rejectReasonNames[tt.want])
+		}
+		if done != nil {
+			done()
+		}
+	}
+	if total, _ := counted("198.51.100.1"); total != 0 {
+		t.Errorf("%d connections counted once done", total)
+	}
+}
+
+func TestInboundLimits(t *testing.T) {
+	withInbound(t, `{"max_conns_per_ip": 2, "max_conns": 3}`)
+
+	var dones []func()
+	for _, tt := range []struct {
+		ip   string
+		want rejectReason
+	}{
+		{"192.0.2.1", 0},
+		{"::ffff:192.0.2.1", 0},
+		{"192.0.2.1", rejectIPLimit},
+		{"192.0.2.2", 0},
+		{"192.0.2.3", rejectLimit},
+		{"192.0.2.1", rejectLimit},
+	} {
+		done, reason := admit(netip.MustParseAddr(tt.ip))
+		if reason != tt.want {
+			t.Fatalf("admit(%s) = %s, want %s", tt.ip, rejectReasonNames[reason], rejectReasonNames[tt.want])
+		}
+		if done != nil {
+			dones = append(dones, done)
+		}
+	}
+	if total, perIP := counted("192.0.2.1"); total != 3 || perIP != 2 {
+		t.Fatalf("counted %d in all and %d from the IP, want 3 and 2", total, perIP)
+	}
+
+	// done releases once, however many times it is called
+	dones[0]()
+	dones[0]()
+	if total, perIP := counted("192.0.2.1"); total != 2 || perIP != 1 {
+		t.Fatalf("counted %d in all and %d from the IP once released, want 2 and 1", total, perIP)
+	}
+	done, reason := admit(netip.MustParseAddr("192.0.2.1"))
+	if reason != 0 {
+		t.Fatalf("admit once released = %s", rejectReasonNames[reason])
+	}
+	dones = append(dones[1:], done)
+
+	for _, done := range dones {
+		done()
+	}
+	inboundConns.Lock()
+	defer inboundConns.Unlock()
+	if inboundConns.total != 0 || len(inboundConns.perIP) != 0 {
+		t.Fatalf("counted %d in all and %v by IP once all released", inboundConns.total, inboundConns.perIP)
+	}
+}
+
+func TestInboundReleaseOnClose(t *testing.T) {
+	withInbound(t, `{"max_conns_per_ip": 1}`)
+	saved := config
+	config.HandshakeTimeout = 5 * time.Second
+	t.Cleanup(func() { config = saved })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tcpRemote(l, func(c net.Conn) net.Conn { return c })
+	t.Cleanup(func() {
+		l.Close()
+		conns.drain(time.Second)
+	})
+
+	// admitted tells whether the server keeps a new connection open for its
+	// handshake, rather than closing it at once.
+	admitted := func() (net.Conn, bool) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = c.Read(make([]byte, 1))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return c, true
+		}
+		return c, false
+	}
+
+	first, ok := admitted()
+	if !ok {
+		t.Fatal("First connection rejected")
+	}
+	if _, ok := admitted(); ok {
+		t.Fatal("Second connection from the IP admitted")
+	}
+
+	first.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if total, _ := counted("127.0.0.1"); total == 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("Connection still counted once closed")
+		}
+	}
+	if _, ok := admitted(); !ok {
+		t.Fatal("Connection rejected once the first closed")
+	}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import "math"
+
+// bloomFilter is a classic Bloom filter using double hashing, after
+// github.com/riobard/go-bloom, with its bits exposed for snapshots.
+type bloomFilter struct {
+	b []byte
+	k int
+}
+
+// newBloomFilter returns a Bloom filter optimal for n entries and false
+// positive rate of p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	k := -math.Log(p) * math.Log2E   // number of hashes
+	m := float64(n) * k * math.Log2E // number of bits
+	// tiny filters still need a byte to index and a hash to test
+	return &bloomFilter{b: make([]byte, max(int(math.Ceil(m/8)), 1)), k: max(int(k), 1)}
+}
+
+func (f *bloomFilter) offset(x, y uint64, i int) uint64 {
+	return (x + uint64(i)*y) % (8 * uint64(len(f.b)))
+}
+
+func (f *bloomFilter) Add(b []byte) {
+	x, y := doubleFNV(b)
+	for i := 0; i < f.k; i++ {
+		o := f.offset(x, y, i)
+		f.b[o/8] |= 1 << (o % 8)
+	}
+}
+
+func (f *bloomFilter) Test(b []byte) bool {
+	x, y := doubleFNV(b)
+	for i := 0; i < f.k; i++ {
+		o := f.offset(x, y, i)
+		if f.b[o/8]&(1<<(o%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) Reset() { clear(f.b) }
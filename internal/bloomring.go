@@ -1,10 +1,11 @@
 package internal
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"hash/fnv"
 	"sync"
-
-	"github.com/riobard/go-bloom"
 )
 
 // simply use Double FNV here as our Bloom Filter hash
@@ -23,7 +24,8 @@ type BloomRing struct {
 	slotPosition int
 	slotCount    int
 	entryCounter int
-	slots        []bloom.Filter
+	advances     uint64 // to the next slot
+	slots        []*bloomFilter
 	mutex        sync.RWMutex
 }
 
@@ -32,10 +34,10 @@ func NewBloomRing(slot, capacity int, falsePositiveRate float64) *BloomRing {
 	r := &BloomRing{
 		slotCapacity: capacity / slot,
 		slotCount:    slot,
-		slots:        make([]bloom.Filter, slot),
+		slots:        make([]*bloomFilter, slot),
 	}
 	for i := 0; i < slot; i++ {
-		r.slots[i] = bloom.New(r.slotCapacity, falsePositiveRate, doubleFNV)
+		r.slots[i] = newBloomFilter(r.slotCapacity, falsePositiveRate)
 	}
 	return r
 }
@@ -57,6 +59,7 @@ func (r *BloomRing) add(b []byte) {
 		slot = r.slots[r.slotPosition]
 		slot.Reset()
 		r.entryCounter = 0
+		r.advances++
 	}
 	r.entryCounter++
 	slot.Add(b)
@@ -81,12 +84,113 @@ func (r *BloomRing) test(b []byte) bool {
 	return false
 }
 
-func (r *BloomRing) Check(b []byte) bool {
+// Len returns the number of entries in r.
+func (r *BloomRing) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	// full slots hold one entry over their capacity
+	return int(min(r.advances, uint64(r.slotCount-1)))*(r.slotCapacity+1) + r.entryCounter
+}
+
+// Cap returns the number of entries r is sized for.
+func (r *BloomRing) Cap() int { return r.slotCount * r.slotCapacity }
+
+// Rotations returns how many times the oldest slot of r was cleared for
+// new entries.
+func (r *BloomRing) Rotations() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.advances < uint64(r.slotCount) {
+		return 0 // only empty slots so far
+	}
+	return r.advances - uint64(r.slotCount-1)
+}
+
+// Check reports whether b, or any of also, is in r, adding b otherwise, in
+// one atomic step.
+func (r *BloomRing) Check(b []byte, also ...[]byte) bool {
+	if r == nil {
+		return false
+	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	if r.Test(b) {
+	if r.test(b) {
 		return true
 	}
-	r.Add(b)
+	for _, a := range also {
+		if r.test(a) {
+			return true
+		}
+	}
+	r.add(b)
 	return false
 }
+
+// Snapshot format: the magic, a version byte, the ring parameters and
+// position as big-endian uint32s, the advances as a big-endian uint64, the
+// bits of each slot, and a CRC-32 (IEEE) of all that precedes it.
+const (
+	snapshotMagic   = "SSBR"
+	snapshotVersion = 2
+	snapshotHeader  = len(snapshotMagic) + 1 + 6*4 + 8
+)
+
+var (
+	ErrSnapshotCorrupt  = errors.New("bloom ring snapshot corrupt")
+	ErrSnapshotVersion  = errors.New("bloom ring snapshot of unknown version")
+	ErrSnapshotMismatch = errors.New("bloom ring snapshot of other parameters")
+)
+
+// MarshalBinary returns a snapshot of r.
+func (r *BloomRing) MarshalBinary() ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	size := len(r.slots[0].b)
+	b := make([]byte, 0, snapshotHeader+len(r.slots)*size+4)
+	b = append(b, snapshotMagic...)
+	b = append(b, snapshotVersion)
+	for _, v := range []int{r.slotCount, r.slotCapacity, r.slots[0].k, size, r.slotPosition, r.entryCounter} {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	b = binary.BigEndian.AppendUint64(b, r.advances)
+	for _, s := range r.slots {
+		b = append(b, s.b...)
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// UnmarshalBinary restores r from a snapshot taken by MarshalBinary of a
+// ring with the same parameters. r is left as is on errors.
+func (r *BloomRing) UnmarshalBinary(b []byte) error {
+	if len(b) < snapshotHeader+4 || string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrSnapshotCorrupt
+	}
+	if b[len(snapshotMagic)] != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+	n := len(b) - 4
+	if crc32.ChecksumIEEE(b[:n]) != binary.BigEndian.Uint32(b[n:]) {
+		return ErrSnapshotCorrupt
+	}
+	var h [6]int
+	for i := range h {
+		h[i] = int(binary.BigEndian.Uint32(b[len(snapshotMagic)+1+4*i:]))
+	}
+	slotCount, slotCapacity, k, size, position, counter := h[0], h[1], h[2], h[3], h[4], h[5]
+	advances := binary.BigEndian.Uint64(b[snapshotHeader-8:])
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if slotCount != r.slotCount || slotCapacity != r.slotCapacity || k != r.slots[0].k || size != len(r.slots[0].b) {
+		return ErrSnapshotMismatch
+	}
+	if n != snapshotHeader+slotCount*size || position >= slotCount {
+		return ErrSnapshotCorrupt
+	}
+	bits := b[snapshotHeader:n]
+	for _, s := range r.slots {
+		bits = bits[copy(s.b, bits):]
+	}
+	r.slotPosition, r.entryCounter, r.advances = position, counter, advances
+	return nil
+}
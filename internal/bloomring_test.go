@@ -1,6 +1,7 @@
 package internal_test
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -52,6 +53,98 @@ func TestBloomRing_NilTestIsFalse(t *testing.T) {
 	}
 }
 
+func TestBloomRing_Check(t *testing.T) {
+	ring := internal.NewBloomRing(internal.DefaultSFSlot, 1000, internal.DefaultSFFPR)
+	if ring.Check([]byte("shadowsocks")) {
+		t.Fatal("Check found a new entry")
+	}
+	if !ring.Check([]byte("shadowsocks")) {
+		t.Fatal("Check missed a repeated entry")
+	}
+	ring.Add([]byte("sent"))
+	if !ring.Check([]byte("received"), []byte("sent")) {
+		t.Fatal("Check missed an entry to test along")
+	}
+	if ring.Test([]byte("received")) {
+		t.Fatal("Check added an entry found along")
+	}
+}
+
+func TestBloomRing_NilCheck(t *testing.T) {
+	var nilRing *internal.BloomRing
+	if nilRing.Check([]byte("shadowsocks")) {
+		t.Fatal("Check should return false for nil BloomRing")
+	}
+}
+
+func TestBloomRing_Tiny(t *testing.T) {
+	for _, tc := range []struct {
+		capacity, slots int
+		fpr             float64
+	}{
+		{1, 1, 0.5},
+		{1, 1, 0.9},
+		{2, 2, 0.5},
+		{3, 1, 1e-6},
+	} {
+		ring := internal.NewBloomRing(tc.slots, tc.capacity, tc.fpr)
+		for i := 0; i < 10; i++ {
+			if ring.Check([]byte(fmt.Sprint(i))) && i == 0 {
+				t.Fatalf("Ring of capacity %d and FPR %v found an entry when empty", tc.capacity, tc.fpr)
+			}
+			if !ring.Test([]byte(fmt.Sprint(i))) {
+				t.Fatalf("Ring of capacity %d and FPR %v missed the last entry", tc.capacity, tc.fpr)
+			}
+		}
+	}
+}
+
+func TestBloomRing_Len(t *testing.T) {
+	ring := internal.NewBloomRing(4, 100, 1e-6)
+	for i := 0; i < 50; i++ {
+		ring.Add([]byte(fmt.Sprint(i)))
+	}
+	if ring.Len() != 50 || ring.Rotations() != 0 {
+		t.Fatalf("Len %d and rotations %d, want 50 and 0", ring.Len(), ring.Rotations())
+	}
+	for i := 50; i < 1000; i++ {
+		ring.Add([]byte(fmt.Sprint(i)))
+	}
+	if ring.Len() > ring.Cap()+4 || ring.Len() < ring.Cap()*3/4 || ring.Rotations() == 0 {
+		t.Fatalf("Len %d of capacity %d with %d rotations once full", ring.Len(), ring.Cap(), ring.Rotations())
+	}
+}
+
+func TestBloomRing_Snapshot(t *testing.T) {
+	ring := internal.NewBloomRing(4, 1000, 1e-6)
+	for i := 0; i < 900; i++ {
+		ring.Add([]byte(fmt.Sprint(i)))
+	}
+	b, err := ring.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := internal.NewBloomRing(4, 1000, 1e-6)
+	if err := restored.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for i := 0; i < 900; i++ {
+		if !restored.Test([]byte(fmt.Sprint(i))) {
+			t.Fatalf("Entry %d missing after restore", i)
+		}
+	}
+
+	b[len(b)/2] ^= 1
+	if err := internal.NewBloomRing(4, 1000, 1e-6).UnmarshalBinary(b); !errors.Is(err, internal.ErrSnapshotCorrupt) {
+		t.Fatalf("Corrupt snapshot restored: %v", err)
+	}
+	b[len(b)/2] ^= 1
+	if err := internal.NewBloomRing(5, 1000, 1e-6).UnmarshalBinary(b); !errors.Is(err, internal.ErrSnapshotMismatch) {
+		t.Fatalf("Snapshot restored into ring of other parameters: %v", err)
+	}
+}
+
 func BenchmarkBloomRing(b *testing.B) {
 	// Generate test samples with different length
 	samples := make([][]byte, internal.DefaultSFCapacity-internal.DefaultSFSlot)
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -19,36 +20,35 @@ const (
 
 const EnvironmentPrefix = "SHADOWSOCKS_"
 
-// A shared instance used for checking salt repeat
-var saltfilter *BloomRing
-
-// Used to initialize the saltfilter singleton only once.
-var initSaltfilterOnce sync.Once
+// Salt filter settings from the environment, read only once.
+var (
+	sfCapacity, sfFPR, sfSlot float64
+	sfErr                     error
+	initSaltfilterOnce        sync.Once
+)
 
-// GetSaltFilterSingleton returns the BloomRing singleton,
-// initializing it on first call.
-func getSaltFilterSingleton() *BloomRing {
+// SaltFilterSettings returns the capacity, false positive rate and slots of
+// salt filters set by the SHADOWSOCKS_SF_* environment variables, or the
+// defaults. A capacity that is not positive disables salt filters. Variables
+// that do not parse keep the defaults, and err tells which.
+func SaltFilterSettings() (capacity int, fpr float64, slot int, err error) {
 	initSaltfilterOnce.Do(func() {
-		var (
-			finalCapacity = DefaultSFCapacity
-			finalFPR      = DefaultSFFPR
-			finalSlot     = float64(DefaultSFSlot)
-		)
+		sfCapacity, sfFPR, sfSlot = DefaultSFCapacity, DefaultSFFPR, DefaultSFSlot
 		for _, opt := range []struct {
 			ENVName string
 			Target  *float64
 		}{
 			{
 				ENVName: "CAPACITY",
-				Target:  &finalCapacity,
+				Target:  &sfCapacity,
 			},
 			{
 				ENVName: "FPR",
-				Target:  &finalFPR,
+				Target:  &sfFPR,
 			},
 			{
 				ENVName: "SLOT",
-				Target:  &finalSlot,
+				Target:  &sfSlot,
 			},
 		} {
 			envKey := EnvironmentPrefix + "SF_" + opt.ENVName
@@ -56,30 +56,12 @@ func getSaltFilterSingleton() *BloomRing {
 			if env != "" {
 				p, err := strconv.ParseFloat(env, 64)
 				if err != nil {
-					panic(fmt.Sprintf("Invalid envrionment `%s` setting in saltfilter: %s", envKey, env))
+					sfErr = errors.Join(sfErr, fmt.Errorf("invalid %s %q", envKey, env))
+					continue
 				}
 				*opt.Target = p
 			}
 		}
-		// Support disable saltfilter by given a negative capacity
-		if finalCapacity <= 0 {
-			return
-		}
-		saltfilter = NewBloomRing(int(finalSlot), int(finalCapacity), finalFPR)
 	})
-	return saltfilter
-}
-
-// TestSalt returns true if salt is repeated
-func TestSalt(b []byte) bool {
-	return getSaltFilterSingleton().Test(b)
-}
-
-// AddSalt salt to filter
-func AddSalt(b []byte) {
-	getSaltFilterSingleton().Add(b)
-}
-
-func CheckSalt(b []byte) bool {
-	return getSaltFilterSingleton().Test(b)
+	return int(sfCapacity), sfFPR, int(sfSlot), sfErr
 }
@@ -1,31 +1,155 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
-var logger = log.New(os.Stderr, "", log.Lshortfile|log.LstdFlags)
+// logger logs at the level of -loglevel, debug with -verbose. Messages about
+// a connection go through its relayLog.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
 
-func logf(f string, v ...interface{}) {
-	if config.Verbose {
-		logger.Output(2, fmt.Sprintf(f, v...))
+// accessLog records relays done, if -accesslog is set.
+var accessLog *slog.Logger
+
+// setupLogging sets up the loggers from the settings of c. Only at startup.
+func (c *fileConfig) setupLogging() error {
+	level := slog.LevelInfo
+	if c.Verbose {
+		level = slog.LevelDebug
+	}
+	if c.LogLevel != "" {
+		level.UnmarshalText([]byte(c.LogLevel)) // checked by resolve
+	}
+	newHandler := func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		if c.LogFormat == "json" {
+			return slog.NewJSONHandler(w, opts)
+		}
+		return slog.NewTextHandler(w, opts)
+	}
+	logger = slog.New(newHandler(os.Stderr, &slog.HandlerOptions{
+		Level:       level,
+		AddSource:   level <= slog.LevelDebug,
+		ReplaceAttr: replaceAttr,
+	}))
+
+	switch c.AccessLog {
+	case "":
+	case "-":
+		accessLog = slog.New(newHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: replaceAttr}))
+	default:
+		f, err := os.OpenFile(c.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		accessLog = slog.New(newHandler(f, &slog.HandlerOptions{ReplaceAttr: replaceAttr}))
+	}
+	return nil
+}
+
+// replaceAttr shortens sources to the file name, and writes addresses and
+// durations as in text also in JSON.
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	switch v := a.Value.Any().(type) {
+	case *slog.Source:
+		a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(v.File), v.Line))
+	case time.Time:
+	case time.Duration:
+		a.Value = slog.StringValue(v.String())
+	case fmt.Stringer:
+		a.Value = slog.StringValue(v.String())
+	}
+	return a
+}
+
+var connIDs atomic.Uint64
+
+// A relayLog logs about a connection or UDP session with its ID, and its user
+// once known, and records it in the access log when done.
+type relayLog struct {
+	*slog.Logger
+	id     uint64
+	user   string
+	client string
+	target string
+	start  time.Time
+	ctr    counter // bytes relayed
+}
+
+func newRelayLog(client string) *relayLog {
+	id := connIDs.Add(1)
+	return &relayLog{Logger: logger.With("conn", id), id: id, client: client, start: time.Now()}
+}
+
+func (r *relayLog) setUser(user string) {
+	if user != "" {
+		r.user = user
+		r.Logger = r.Logger.With("user", user)
+	}
+}
+
+// done records the relay ended for reason, with err if any, in the access log.
+func (r *relayLog) done(reason string, err error) {
+	if accessLog == nil {
+		return
+	}
+	attrs := []any{"conn", r.id}
+	if r.user != "" {
+		attrs = append(attrs, "user", r.user)
+	}
+	attrs = append(attrs,
+		"client", r.client,
+		"target", r.target,
+		"up", r.ctr.up.Load(),
+		"down", r.ctr.down.Load(),
+		"duration", time.Since(r.start).Round(time.Millisecond),
+		"close", reason,
+	)
+	if err != nil {
+		attrs = append(attrs, "err", err)
 	}
+	accessLog.Info("access", attrs...)
 }
 
+// end records the relay ended with err, or done if nil.
+func (r *relayLog) end(err error) {
+	reason := endReason(err)
+	if reason != "error" {
+		err = nil
+	}
+	r.done(reason, err)
+}
+
+// endReason is the reason for a relay to end with err.
+func endReason(err error) string {
+	switch {
+	case draining.Load() && errors.Is(err, net.ErrClosed):
+		return "shutdown"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, errIdle):
+		return "timeout"
+	case err != nil:
+		return "error"
+	}
+	return "eof"
+}
+
+// logHelper logs the output of plugins.
 type logHelper struct {
-	prefix string
+	plugin string
 }
 
 func (l *logHelper) Write(p []byte) (n int, err error) {
-	if config.Verbose {
-		logger.Printf("%s%s\n", l.prefix, p)
-		return len(p), nil
-	}
+	logger.Debug(string(p), "plugin", l.plugin)
 	return len(p), nil
 }
 
-func newLogHelper(prefix string) *logHelper {
-	return &logHelper{prefix}
+func newLogHelper(plugin string) *logHelper {
+	return &logHelper{plugin}
 }
@@ -15,44 +15,78 @@ import (
 	"time"
 
 	"github.com/shadowsocks/go-shadowsocks2/core"
-	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
 )
 
 var config struct {
-	Verbose    bool
-	UDPTimeout time.Duration
-	TCPCork    bool
+	Verbose          bool
+	UDPTimeout       time.Duration
+	ShutdownTimeout  time.Duration
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+	HalfCloseTimeout time.Duration
+	TrafficLog       time.Duration
+	TCPCork          bool
+	DeferReply       bool
+	QuotaFile        string
+	SaltFile         string
 }
 
-func main() {
-
-	var flags struct {
-		Client     string
-		Server     string
-		Cipher     string
-		Key        string
-		Password   string
-		Keygen     int
-		Socks      string
-		RedirTCP   string
-		RedirTCP6  string
-		TCPTun     string
-		UDPTun     string
-		UDPSocks   bool
-		UDP        bool
-		TCP        bool
-		Plugin     string
-		PluginOpts string
-	}
+var flags struct {
+	Config         string
+	Client         string
+	Server         string
+	Cipher         string
+	Key            string
+	Password       string
+	Keygen         int
+	Socks          string
+	HTTP           string
+	Mixed          string
+	Auth           string
+	RedirTCP       string
+	RedirTCP6      string
+	TCPTun         string
+	UDPTun         string
+	UDPSocks       bool
+	UDP            bool
+	TCP            bool
+	Plugin         string
+	PluginOpts     string
+	Users          string
+	Timestamp      bool
+	ManagerAddress string
+	Metrics        string
+	LogLevel       string
+	LogFormat      string
+	AccessLog      string
+	OutboundAllow  string
+	OutboundDeny   string
+	InboundAllow   string
+	InboundDeny    string
+	MaxConnsPerIP  int
+	MaxConns       int
+	QuotaFile      string
+	SaltFile       string
+	Fallback       string
+}
 
-	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
-	flag.StringVar(&flags.Cipher, "cipher", "AEAD_CHACHA20_POLY1305", "available ciphers: "+strings.Join(core.ListCipher(), " "))
+func main() {
+	flag.StringVar(&flags.Config, "config", "", "JSON configuration file (overridden by other flags)")
+	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode, same as -loglevel debug")
+	flag.StringVar(&flags.LogLevel, "loglevel", "", "log level: debug, info, warn or error (default info)")
+	flag.StringVar(&flags.LogFormat, "logformat", "text", "log format: text or json")
+	flag.StringVar(&flags.AccessLog, "accesslog", "", "record relays done in this file, - for stderr")
+	flag.StringVar(&flags.Cipher, "cipher", defaultCipher, "available ciphers: "+strings.Join(core.ListCipher(), " "))
 	flag.StringVar(&flags.Key, "key", "", "base64url-encoded key (derive from password if empty)")
 	flag.IntVar(&flags.Keygen, "keygen", 0, "generate a base64url-encoded random key of given length in byte")
 	flag.StringVar(&flags.Password, "password", "", "password")
 	flag.StringVar(&flags.Server, "s", "", "server listen address or url")
 	flag.StringVar(&flags.Client, "c", "", "client connect address or url")
 	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS listen address")
+	flag.StringVar(&flags.HTTP, "http", "", "(client-only) HTTP proxy listen address")
+	flag.StringVar(&flags.Mixed, "mixed", "", "(client-only) SOCKS5, SOCKS4 and HTTP proxy listen address")
+	flag.StringVar(&flags.Auth, "auth", "", "(client-only) JSON file of names and passwords required of SOCKS5 and HTTP proxy clients")
 	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
 	flag.StringVar(&flags.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
 	flag.StringVar(&flags.RedirTCP6, "redir6", "", "(client-only) redirect TCP IPv6 from this address")
@@ -62,8 +96,27 @@ func main() {
 	flag.StringVar(&flags.PluginOpts, "plugin-opts", "", "Set SIP003 plugin options. (e.g., \"server;tls;host=mydomain.me\")")
 	flag.BoolVar(&flags.UDP, "udp", false, "(server-only) enable UDP support")
 	flag.BoolVar(&flags.TCP, "tcp", true, "(server-only) enable TCP support")
+	flag.BoolVar(&flags.Timestamp, "timestamp", false, "start payloads with timestamps to reject replays, for AEAD ciphers other than SIP022 ones (both ends must enable it)")
+	flag.StringVar(&flags.Users, "users", "", "(server-only) JSON file of users (name, password and optional method or key) sharing the port")
+	flag.StringVar(&flags.ManagerAddress, "manager-address", "", "(server-only) UDP address or unix socket path of the ss-manager compatible API")
+	flag.StringVar(&flags.OutboundAllow, "outbound-allow", "", "(server-only) targets to allow even if private (CIDRs, IPs or domains, comma separated)")
+	flag.StringVar(&flags.OutboundDeny, "outbound-deny", "", "(server-only) targets to deny (CIDRs, IPs or domains, comma separated)")
+	flag.StringVar(&flags.InboundAllow, "inbound-allow", "", "(server-only) only accept clients from these CIDRs or IPs (comma separated)")
+	flag.StringVar(&flags.InboundDeny, "inbound-deny", "", "(server-only) reject clients from these CIDRs or IPs (comma separated)")
+	flag.IntVar(&flags.MaxConnsPerIP, "max-conns-per-ip", 0, "(server-only) max concurrent TCP connections and UDP sessions per client IP (0 for no limit)")
+	flag.IntVar(&flags.MaxConns, "max-conns", 0, "(server-only) max concurrent TCP connections and UDP sessions in all (0 for no limit)")
+	flag.StringVar(&flags.Fallback, "fallback", "", "(server-only) proxy clients failing to authenticate to this address, such as a web server")
+	flag.StringVar(&flags.QuotaFile, "quotafile", "", "(server-only) JSON file to keep the quota usage of users in across restarts")
+	flag.StringVar(&flags.SaltFile, "saltfile", "", "file to keep the salt filters against replays in across restarts")
+	flag.StringVar(&flags.Metrics, "metrics", "", "serve Prometheus metrics at /metrics on this address")
 	flag.BoolVar(&config.TCPCork, "tcpcork", false, "coalesce writing first few packets")
+	flag.BoolVar(&config.DeferReply, "deferreply", false, "(client-only) reply to SOCKS5 CONNECT once connected to the server, with the error if it failed")
 	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.DurationVar(&config.HandshakeTimeout, "handshaketimeout", time.Minute, "time for TCP clients to send the target address, or the SOCKS handshake (0 for no limit)")
+	flag.DurationVar(&config.IdleTimeout, "idletimeout", 0, "close TCP relays idle in both directions for this long (0 to disable)")
+	flag.DurationVar(&config.HalfCloseTimeout, "halfclosetimeout", 5*time.Second, "time for one direction of a TCP relay to finish after the other")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdowntimeout", 30*time.Second, "time for connections to finish on SIGINT or SIGTERM before being cut")
+	flag.DurationVar(&config.TrafficLog, "trafficlog", 0, "(server-only) interval to log traffic per port and user (0 to disable)")
 	flag.Parse()
 
 	if flags.Keygen > 0 {
@@ -73,123 +126,105 @@ func main() {
 		return
 	}
 
-	if flags.Client == "" && flags.Server == "" {
+	if flags.Config == "" && flags.Client == "" && flags.Server == "" && flags.ManagerAddress == "" {
 		flag.Usage()
 		return
 	}
 
-	var key []byte
-	if flags.Key != "" {
-		k, err := base64.URLEncoding.DecodeString(flags.Key)
-		if err != nil {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	cfg, err := readConfig(set)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.setGlobals()
+	if err := cfg.setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	if _, _, _, err := shadowaead.SaltFilterSettings(); err != nil {
+		logger.Warn("taking the default salt filter settings", "err", err)
+	}
+	if config.QuotaFile != "" {
+		if err := loadQuotas(config.QuotaFile); err != nil {
 			log.Fatal(err)
 		}
-		key = k
 	}
-
-	if flags.Client != "" { // client mode
-		addr := flags.Client
-		cipher := flags.Cipher
-		password := flags.Password
-		if flags.Password == "" {
-			password = os.Getenv("SS_PASSWORD")
+	if config.SaltFile != "" {
+		if err := loadSaltFilters(config.SaltFile); err != nil {
+			logger.Warn("starting with empty salt filters", "err", err)
 		}
-		var err error
-
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
-			}
+		go watchSaltFilters(config.SaltFile)
+	}
+	if err := reconfigure(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Role == "server" {
+		go watchQuotas(config.QuotaFile)
+	}
+	if config.TrafficLog > 0 {
+		go logTraffic(config.TrafficLog)
+	}
+	if cfg.Metrics != "" {
+		if err := serveMetrics(cfg.Metrics); err != nil {
+			log.Fatal(err)
 		}
-
-		udpAddr := addr
-
-		ciph, err := core.PickCipher(cipher, key, password)
+	}
+	if cfg.Manager != "" {
+		pc, err := listenManager(cfg.Manager)
 		if err != nil {
 			log.Fatal(err)
 		}
+		logger.Info("manager listening", "addr", cfg.Manager)
+		go serveManager(pc)
+	}
 
-		if flags.Plugin != "" {
-			addr, err = startPlugin(flags.Plugin, flags.PluginOpts, addr, false)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		if flags.UDPTun != "" {
-			for _, tun := range strings.Split(flags.UDPTun, ",") {
-				p := strings.Split(tun, "=")
-				go udpLocal(p[0], udpAddr, p[1], ciph.PacketConn)
-			}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
 		}
-
-		if flags.TCPTun != "" {
-			for _, tun := range strings.Split(flags.TCPTun, ",") {
-				p := strings.Split(tun, "=")
-				go tcpTun(p[0], addr, p[1], ciph.StreamConn)
-			}
+		logger.Info("reloading configuration")
+		cfg, err := readConfig(set)
+		if err != nil {
+			logger.Error("failed to reload configuration", "err", err)
+			continue
 		}
-
-		if flags.Socks != "" {
-			socks.UDPEnabled = flags.UDPSocks
-			go socksLocal(flags.Socks, addr, ciph.StreamConn)
-			if flags.UDPSocks {
-				go udpSocksLocal(flags.Socks, udpAddr, ciph.PacketConn)
-			}
+		if err := reconfigure(cfg); err != nil {
+			logger.Error("failed to reload configuration", "err", err)
 		}
-
-		if flags.RedirTCP != "" {
-			go redirLocal(flags.RedirTCP, addr, ciph.StreamConn)
+	}
+	shutdown(config.ShutdownTimeout)
+	if config.QuotaFile != "" {
+		if err := saveQuotas(config.QuotaFile); err != nil {
+			logger.Error("failed to save quota usage", "err", err)
 		}
-
-		if flags.RedirTCP6 != "" {
-			go redir6Local(flags.RedirTCP6, addr, ciph.StreamConn)
+	}
+	if config.SaltFile != "" {
+		if err := saveSaltFilters(config.SaltFile); err != nil {
+			logger.Error("failed to save salt filters", "err", err)
 		}
 	}
+	killPlugin()
+}
 
-	if flags.Server != "" { // server mode
-		addr := flags.Server
-		cipher := flags.Cipher
-		password := flags.Password
-		if flags.Password == "" {
-			password = os.Getenv("SS_PASSWORD")
-		}
+// readConfig reads the configuration file of -config, if any, and overrides
+// it with the flags in set.
+func readConfig(set map[string]bool) (*fileConfig, error) {
+	cfg := new(fileConfig)
+	if flags.Config != "" {
 		var err error
-
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		udpAddr := addr
-
-		if flags.Plugin != "" {
-			addr, err = startPlugin(flags.Plugin, flags.PluginOpts, addr, true)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		ciph, err := core.PickCipher(cipher, key, password)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if flags.UDP {
-			go udpRemote(udpAddr, ciph.PacketConn)
-		}
-		if flags.TCP {
-			go tcpRemote(addr, ciph.StreamConn)
+		if cfg, err = loadConfig(flags.Config); err != nil {
+			return nil, err
 		}
 	}
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-	killPlugin()
+	if err := cfg.applyFlags(set); err != nil {
+		return nil, err
+	}
+	if err := cfg.resolve(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 func parseURL(s string) (addr, cipher, password string, err error) {
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The manager API is that of shadowsocks-libev: each datagram is a command,
+//
+//	add: {"server_port": 8001, "password": "secret"}
+//	remove: {"server_port": 8001}
+//	list
+//	ping
+//	traffic
+//
+// answered with "ok", "err", a JSON list of the ports added, or for ping the
+// bytes relayed on each port, as pushed every statInterval to the last
+// sender of a command:
+//
+//	stat: {"8001": 11370}
+//
+// The traffic command is ours, answered with the bytes and connections of
+// each port and user:
+//
+//	{"ports": {"8001": {"upload": 1370, "download": 10000, "connections": 3, "active": 1}}, "users": {}}
+
+const statInterval = 10 * time.Second
+
+// managed holds the configuration from the file and flags, and the servers
+// added through the manager API.
+var managed struct {
+	sync.Mutex
+	base  *fileConfig
+	ports map[int][]serverConfig // one per host to listen on
+}
+
+// managerRequest is the argument of add and remove commands.
+type managerRequest struct {
+	Port       jsonPort   `json:"server_port"`
+	Password   string     `json:"password"`
+	Method     string     `json:"method"`
+	Mode       string     `json:"mode"`
+	Plugin     string     `json:"plugin"`
+	PluginOpts string     `json:"plugin_opts"`
+	RateLimit  *rateLimit `json:"rate_limit"`
+}
+
+// jsonPort is a port given as a JSON number or string.
+type jsonPort int
+
+func (p *jsonPort) UnmarshalJSON(b []byte) error {
+	n, err := strconv.Atoi(strings.Trim(string(b), `"`))
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port %s", b)
+	}
+	*p = jsonPort(n)
+	return nil
+}
+
+// reconfigure applies base along with the servers added through the manager API.
+func reconfigure(base *fileConfig) error {
+	managed.Lock()
+	defer managed.Unlock()
+	managed.base = base
+	return applyManaged()
+}
+
+// applyManaged applies the base configuration along with the servers added
+// through the manager API. managed must be locked.
+func applyManaged() error {
+	c := *managed.base
+	c.Servers = slices.Clip(c.Servers)
+	ports := make([]int, 0, len(managed.ports))
+	for port := range managed.ports {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	for _, port := range ports {
+		c.Servers = append(c.Servers, managed.ports[port]...)
+	}
+	return c.apply()
+}
+
+// addPort starts serving the port of req, or swaps its cipher if served already.
+func addPort(req managerRequest) error {
+	if req.Password == "" {
+		return errors.New("missing password")
+	}
+
+	managed.Lock()
+	defer managed.Unlock()
+	base := managed.base
+	port := strconv.Itoa(int(req.Port))
+	for _, s := range base.Servers {
+		if _, p, _ := net.SplitHostPort(s.Address); p == port {
+			return fmt.Errorf("port %s is in the configuration", port)
+		}
+	}
+
+	hosts := base.Server
+	if len(hosts) == 0 {
+		hosts = hostList{""}
+	}
+	var servers []serverConfig
+	for _, h := range hosts {
+		s := serverConfig{
+			Address:    net.JoinHostPort(h, port),
+			Method:     cmp.Or(req.Method, base.Method),
+			Password:   req.Password,
+			Plugin:     cmp.Or(req.Plugin, base.Plugin),
+			PluginOpts: cmp.Or(req.PluginOpts, base.PluginOpts),
+			Mode:       cmp.Or(req.Mode, base.Mode),
+			RateLimit:  req.RateLimit,
+			Timestamp:  base.Timestamp,
+			SaltFilter: base.SaltFilter,
+		}
+		if err := s.resolve(true); err != nil {
+			return err
+		}
+		servers = append(servers, s)
+	}
+
+	if managed.ports == nil {
+		managed.ports = make(map[int][]serverConfig)
+	}
+	old, ok := managed.ports[int(req.Port)]
+	managed.ports[int(req.Port)] = servers
+	if err := applyManaged(); err != nil {
+		if ok {
+			managed.ports[int(req.Port)] = old
+		} else {
+			delete(managed.ports, int(req.Port))
+		}
+		applyManaged()
+		return err
+	}
+	return nil
+}
+
+// removePort stops serving the port of req.
+func removePort(req managerRequest) error {
+	managed.Lock()
+	defer managed.Unlock()
+	if _, ok := managed.ports[int(req.Port)]; !ok {
+		return fmt.Errorf("port %d is not managed", req.Port)
+	}
+	delete(managed.ports, int(req.Port))
+	return applyManaged()
+}
+
+// listPorts returns the ports added through the manager API in JSON.
+func listPorts() []byte {
+	managed.Lock()
+	defer managed.Unlock()
+	type entry struct {
+		Port     string `json:"server_port"`
+		Password string `json:"password"`
+		Method   string `json:"method"`
+	}
+	list := []entry{}
+	for port, servers := range managed.ports {
+		list = append(list, entry{strconv.Itoa(port), servers[0].Password, servers[0].Method})
+	}
+	slices.SortFunc(list, func(a, b entry) int { return strings.Compare(a.Port, b.Port) })
+	b, _ := json.Marshal(list)
+	return b
+}
+
+// stat returns the stat message of the traffic of all ports.
+func stat() []byte {
+	m := make(map[string]int64)
+	for port, n := range portTraffic() {
+		m[strconv.Itoa(port)] = n
+	}
+	b, _ := json.Marshal(m)
+	return append([]byte("stat: "), b...)
+}
+
+// trafficJSON returns the traffic of each port and user in JSON.
+func trafficJSON() []byte {
+	ports, users := trafficStats()
+	m := struct {
+		Ports map[string]trafficStat `json:"ports"`
+		Users map[string]trafficStat `json:"users"`
+	}{make(map[string]trafficStat), users}
+	for port, s := range ports {
+		m.Ports[strconv.Itoa(port)] = s
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// parseManager parses the manager command in msg, with the argument of add
+// and remove commands.
+func parseManager(msg []byte) (cmd string, req managerRequest, err error) {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(string(msg)), ":")
+	switch cmd {
+	case "add", "remove":
+		if err := json.Unmarshal([]byte(arg), &req); err != nil {
+			return cmd, req, err
+		}
+		if req.Port == 0 {
+			return cmd, req, errors.New("missing server_port")
+		}
+	case "list", "ping", "traffic":
+	default:
+		return cmd, req, fmt.Errorf("unknown command %q", cmd)
+	}
+	return cmd, req, nil
+}
+
+// handleManager runs the manager command in msg and returns the reply.
+func handleManager(msg []byte) []byte {
+	cmd, req, err := parseManager(msg)
+	if err == nil {
+		switch cmd {
+		case "add":
+			err = addPort(req)
+		case "remove":
+			err = removePort(req)
+		case "list":
+			return listPorts()
+		case "ping":
+			return stat()
+		case "traffic":
+			return trafficJSON()
+		}
+	}
+	if err != nil {
+		logger.Warn("manager command failed", "cmd", cmd, "err", err)
+		return []byte("err")
+	}
+	logger.Info("manager command", "cmd", cmd, "port", int(req.Port))
+	return []byte("ok")
+}
+
+// listenManager listens for manager commands on a UDP address, or on the
+// path of a unix datagram socket.
+func listenManager(addr string) (net.PacketConn, error) {
+	if strings.Contains(addr, ":") {
+		return net.ListenPacket("udp", addr)
+	}
+	os.Remove(addr) // left over by a previous run
+	return net.ListenPacket("unixgram", addr)
+}
+
+// serveManager answers manager commands on pc, and pushes the traffic of
+// ports to the last sender of a command.
+func serveManager(pc net.PacketConn) {
+	var mu sync.Mutex
+	var peer net.Addr
+	go func() {
+		for range time.Tick(statInterval) {
+			mu.Lock()
+			p := peer
+			mu.Unlock()
+			if p != nil {
+				pc.WriteTo(stat(), p)
+			}
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn("manager read error", "err", err)
+			continue
+		}
+		reply := handleManager(buf[:n])
+		if ua, ok := addr.(*net.UnixAddr); addr == nil || ok && ua.Name == "" {
+			continue // unbound unix sockets cannot be replied to
+		}
+		mu.Lock()
+		peer = addr
+		mu.Unlock()
+		if _, err := pc.WriteTo(reply, addr); err != nil {
+			logger.Warn("manager write error", "err", err)
+		}
+	}
+}
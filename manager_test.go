@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseManager(t *testing.T) {
+	for _, tt := range []struct {
+		msg string
+		cmd string
+		req managerRequest
+		err string
+	}{
+		{`add: {"server_port": 8001, "password": "secret"}`, "add", managerRequest{Port: 8001, Password: "secret"}, ""},
+		{`add: {"server_port": "8001", "password": "secret", "method": "aes-256-gcm", "mode": "tcp_and_udp"}`, "add",
+			managerRequest{Port: 8001, Password: "secret", Method: "aes-256-gcm", Mode: "tcp_and_udp"}, ""},
+		{`add:{"server_port":8001,"password":"secret","rate_limit":{"up":1000}}` + "\n", "add",
+			managerRequest{Port: 8001, Password: "secret", RateLimit: &rateLimit{Up: 1000}}, ""},
+		{`remove: {"server_port": 8001}`, "remove", managerRequest{Port: 8001}, ""},
+		{"list", "list", managerRequest{}, ""},
+		{"ping\n", "ping", managerRequest{}, ""},
+		{"traffic", "traffic", managerRequest{}, ""},
+		{`add: {"server_port": 8001, "password": "secret"`, "add", managerRequest{}, "unexpected end of JSON input"},
+		{`add: {"server_port": 70000, "password": "secret"}`, "add", managerRequest{}, "invalid port 70000"},
+		{`add: {"server_port": "http", "password": "secret"}`, "add", managerRequest{}, `invalid port "http"`},
+		{`add: {"password": "secret"}`, "add", managerRequest{}, "missing server_port"},
+		{"remove", "remove", managerRequest{}, "unexpected end of JSON input"},
+		{`remove: {}`, "remove", managerRequest{}, "missing server_port"},
+		{"stat: {}", "stat", managerRequest{}, `unknown command "stat"`},
+		{"", "", managerRequest{}, `unknown command ""`},
+	} {
+		cmd, req, err := parseManager([]byte(tt.msg))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseManager(%q) error %v, want %q", tt.msg, err, tt.err)
+			}
+			if cmd != tt.cmd {
+				t.Errorf("parseManager(%q) command %q, want %q", tt.msg, cmd, tt.cmd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseManager(%q): %v", tt.msg, err)
+			continue
+		}
+		if cmd != tt.cmd {
+			t.Errorf("parseManager(%q) command %q, want %q", tt.msg, cmd, tt.cmd)
+		}
+		if (req.RateLimit == nil) != (tt.req.RateLimit == nil) || req.RateLimit != nil && *req.RateLimit != *tt.req.RateLimit {
+			t.Errorf("parseManager(%q) rate limit %v, want %v", tt.msg, req.RateLimit, tt.req.RateLimit)
+		}
+		req.RateLimit, tt.req.RateLimit = nil, nil
+		if req != tt.req {
+			t.Errorf("parseManager(%q) request %+v, want %+v", tt.msg, req, tt.req)
+		}
+	}
+}
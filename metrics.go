@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Reasons for servers to fail connections.
+type failReason int
+
+const (
+	failBadSalt          failReason = iota // does not authenticate with any key
+	failRepeatedSalt                       // replayed
+	failBadTimestamp                       // replayed later, or clock off
+	failTargetAddress                      // no valid target address after decryption
+	failRead                               // closed or broken before the target address
+	failHandshakeTimeout                   // target address not received in time
+	failDial                               // target unreachable
+	failDenied                             // target denied by the outbound ACL
+	failQuota                              // user over quota
+	numFailReasons
+)
+
+var failReasonNames = [numFailReasons]string{"bad_salt", "repeated_salt", "bad_timestamp", "target_address", "read", "handshake_timeout", "dial", "denied", "quota"}
+
+// readFailReason classifies err reading the target address from a client.
+func readFailReason(err error) failReason {
+	var se socks.Error
+	var ne net.Error
+	switch {
+	case errors.Is(err, shadowaead.ErrRepeatedSalt):
+		return failRepeatedSalt
+	case errors.Is(err, shadowaead.ErrBadTimestamp):
+		return failBadTimestamp
+	case errors.As(err, &se):
+		return failTargetAddress
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return failHandshakeTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &ne):
+		return failRead
+	}
+	return failBadSalt
+}
+
+// metrics are the values served by -metrics besides the traffic counters.
+var metrics struct {
+	relays         atomic.Int64 // TCP connections being relayed
+	accepted       atomic.Int64 // TCP connections accepted by servers
+	failed         [numFailReasons]atomic.Int64
+	rejected       [numRejectReasons]atomic.Int64 // clients rejected by the inbound policy
+	fallbacks      atomic.Int64                   // TCP connections failing to authenticate proxied to the fallback
+	natEntries     atomic.Int64                   // UDP NAT entries of all tables
+	udpDenied      atomic.Int64                   // UDP packets to targets denied by the outbound ACL
+	pluginRestarts atomic.Int64
+	dialLatency    histogram // of servers to targets
+}
+
+// A histogram counts durations in buckets of upper bounds in seconds.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Int64 // the last for +Inf
+	sum    atomic.Int64                          // nanoseconds
+}
+
+var latencyBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func (h *histogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(latencyBuckets[:], d.Seconds())
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// serveMetrics serves the metrics in Prometheus text format on addr.
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("metrics listening", "addr", l.Addr())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	go http.Serve(l, mux)
+	return nil
+}
+
+// labelEscaper escapes label values for the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w io.Writer) {
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("ss_tcp_active_relays", "gauge", "TCP connections being relayed.")
+	fmt.Fprintf(w, "ss_tcp_active_relays %d\n", metrics.relays.Load())
+	header("ss_tcp_accepted_total", "counter", "TCP connections accepted by servers.")
+	fmt.Fprintf(w, "ss_tcp_accepted_total %d\n", metrics.accepted.Load())
+	header("ss_tcp_failed_total", "counter", "TCP connections failed by servers, by reason.")
+	for i := range metrics.failed {
+		fmt.Fprintf(w, "ss_tcp_failed_total{reason=%q} %d\n", failReasonNames[i], metrics.failed[i].Load())
+	}
+	header("ss_tcp_fallbacks_total", "counter", "TCP connections not served proxied to the fallback.")
+	fmt.Fprintf(w, "ss_tcp_fallbacks_total %d\n", metrics.fallbacks.Load())
+	header("ss_inbound_rejected_total", "counter", "TCP connections and UDP sessions rejected by servers before decryption, by reason.")
+	for i := rejectDenied; i < numRejectReasons; i++ {
+		fmt.Fprintf(w, "ss_inbound_rejected_total{reason=%q} %d\n", rejectReasonNames[i], metrics.rejected[i].Load())
+	}
+	header("ss_udp_nat_entries", "gauge", "UDP NAT table entries.")
+	fmt.Fprintf(w, "ss_udp_nat_entries %d\n", metrics.natEntries.Load())
+	header("ss_udp_denied_total", "counter", "UDP packets dropped by servers for targets denied by the outbound ACL.")
+	fmt.Fprintf(w, "ss_udp_denied_total %d\n", metrics.udpDenied.Load())
+	header("ss_plugin_restarts_total", "counter", "SIP003 plugins restarted on reloads.")
+	fmt.Fprintf(w, "ss_plugin_restarts_total %d\n", metrics.pluginRestarts.Load())
+
+	header("ss_dial_duration_seconds", "histogram", "Time for servers to connect to targets.")
+	var n int64
+	for i, le := range latencyBuckets {
+		n += metrics.dialLatency.counts[i].Load()
+		fmt.Fprintf(w, "ss_dial_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), n)
+	}
+	n += metrics.dialLatency.counts[len(latencyBuckets)].Load()
+	fmt.Fprintf(w, "ss_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", n)
+	fmt.Fprintf(w, "ss_dial_duration_seconds_sum %g\n", time.Duration(metrics.dialLatency.sum.Load()).Seconds())
+	fmt.Fprintf(w, "ss_dial_duration_seconds_count %d\n", n)
+
+	ports, users := trafficStats()
+	header("ss_port_bytes_total", "counter", "Payload bytes relayed by servers for clients, by port and direction.")
+	for _, port := range slices.Sorted(maps.Keys(ports)) {
+		s := ports[port]
+		fmt.Fprintf(w, "ss_port_bytes_total{port=\"%d\",direction=\"up\"} %d\n", port, s.Up)
+		fmt.Fprintf(w, "ss_port_bytes_total{port=\"%d\",direction=\"down\"} %d\n", port, s.Down)
+	}
+	header("ss_port_connections_total", "counter", "TCP connections and UDP sessions relayed by servers, by port.")
+	for _, port := range slices.Sorted(maps.Keys(ports)) {
+		fmt.Fprintf(w, "ss_port_connections_total{port=\"%d\"} %d\n", port, ports[port].Conns)
+	}
+	header("ss_user_bytes_total", "counter", "Payload bytes relayed by servers for clients, by user and direction.")
+	for _, user := range slices.Sorted(maps.Keys(users)) {
+		s := users[user]
+		fmt.Fprintf(w, "ss_user_bytes_total{user=\"%s\",direction=\"up\"} %d\n", labelEscaper.Replace(user), s.Up)
+		fmt.Fprintf(w, "ss_user_bytes_total{user=\"%s\",direction=\"down\"} %d\n", labelEscaper.Replace(user), s.Down)
+	}
+	header("ss_user_connections_total", "counter", "TCP connections and UDP sessions relayed by servers, by user.")
+	for _, user := range slices.Sorted(maps.Keys(users)) {
+		fmt.Fprintf(w, "ss_user_connections_total{user=\"%s\"} %d\n", labelEscaper.Replace(user), users[user].Conns)
+	}
+
+	filters := saltFilterStats()
+	header("ss_salt_filter_fill_ratio", "gauge", "Salts remembered against replays over the capacity, by port and user.")
+	for _, f := range filters {
+		var ratio float64
+		if f.Capacity > 0 {
+			ratio = min(float64(f.Entries)/float64(f.Capacity), 1)
+		}
+		fmt.Fprintf(w, "ss_salt_filter_fill_ratio{port=\"%d\",user=\"%s\"} %g\n", f.port, labelEscaper.Replace(f.user), ratio)
+	}
+	header("ss_salt_filter_rotations_total", "counter", "Times the oldest salts remembered against replays were forgotten for new ones, by port and user.")
+	for _, f := range filters {
+		fmt.Fprintf(w, "ss_salt_filter_rotations_total{port=\"%d\",user=\"%s\"} %d\n", f.port, labelEscaper.Replace(f.user), f.Rotations)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Create a proxy on l for SOCKS5, SOCKS4, SOCKS4a and HTTP, told apart by
+// the first byte of each connection, and proxy to server, with the settings
+// of the listener from ps.
+func mixedLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn, ps func() proxySettings) {
+	logger.Info("mixed proxy", "local", l.Addr(), "server", server)
+	acceptLocal(l, func(c net.Conn) { serveMixed(c, server, shadow, ps()) })
+}
+
+// serveMixed serves c as SOCKS5, SOCKS4, SOCKS4a or HTTP by its first byte,
+// proxying to server. Clients authenticate with the credentials of
+// settings, if any, which SOCKS4 cannot.
+func serveMixed(c net.Conn, server string, shadow func(net.Conn) net.Conn, settings proxySettings) {
+	r := bufio.NewReader(c)
+	setHandshakeDeadline(c)
+	b, err := r.Peek(1)
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		logger.Debug("failed to read proxy request", "client", c.RemoteAddr(), "err", err)
+		return
+	}
+	switch b[0] {
+	case 5:
+		socksLocalConn(&bufConn{c, r}, server, shadow, settings)
+	case 4:
+		if settings.creds != nil {
+			logger.Debug("SOCKS4 refused for lack of authentication", "client", c.RemoteAddr())
+			return
+		}
+		tcpLocalConn(&bufConn{c, r}, server, shadow, func(c net.Conn) (socks.Addr, error) { return socks.Handshake4(c) })
+	default:
+		serveHTTP(c, r, server, shadow, settings.creds)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// mixedProxy returns a client connection to a mixed proxy through s with
+// creds.
+func mixedProxy(t *testing.T, s *plainServer, creds credentials) net.Conn {
+	client, c := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		serveMixed(c, s.Addr().String(), func(c net.Conn) net.Conn { return c }, proxySettings{creds: creds})
+	}()
+	t.Cleanup(func() { client.Close(); <-done })
+	return client
+}
+
+func TestMixedDispatch(t *testing.T) {
+	backend := httptest.NewServer(echoHeaders)
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, tt := range []struct {
+		name      string
+		creds     credentials
+		handshake []byte // sent before the HTTP request, if not empty
+		reply     int    // bytes replied to the handshake
+		path      string // of the HTTP request
+		ok        bool
+	}{
+		{"SOCKS5", nil, append([]byte{5, 1, 0, 5, 1, 0}, socks.ParseAddr(host)...), 2 + 10, "/", true},
+		{"SOCKS5 with credentials", credentials{"alice": "secret"},
+			append([]byte{5, 1, 2, 1, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't', 5, 1, 0}, socks.ParseAddr(host)...), 2 + 2 + 10, "/", true},
+		{"SOCKS4", nil, []byte{4, 1, byte(port >> 8), byte(port), 127, 0, 0, 1, 0}, 8, "/", true},
+		{"SOCKS4a", nil, append([]byte{4, 1, byte(port >> 8), byte(port), 0, 0, 0, 1, 'u', 0}, "127.0.0.1\x00"...), 8, "/", true},
+		{"SOCKS4 without credentials", credentials{"alice": "secret"}, []byte{4, 1, byte(port >> 8), byte(port), 127, 0, 0, 1, 0}, 0, "/", false},
+		{"HTTP", nil, nil, 0, backend.URL + "/", true},
+	} {
+		s := newPlainServer(t)
+		c := mixedProxy(t, s, tt.creds)
+		r := bufio.NewReader(c)
+		if len(tt.handshake) > 0 {
+			c.Write(tt.handshake)
+			if _, err := io.ReadFull(r, make([]byte, tt.reply)); err != nil {
+				t.Fatalf("%s: read reply: %v", tt.name, err)
+			}
+		}
+		req := "GET " + tt.path + " HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n"
+		if tt.creds == nil {
+			req = "GET " + tt.path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		}
+		c.Write([]byte(req))
+		resp, err := http.ReadResponse(r, nil)
+		if !tt.ok {
+			if err == nil {
+				t.Fatalf("%s: proxied with status %d", tt.name, resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: read response: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.name, resp.StatusCode)
+		}
+		if got := s.streams(); len(got) != 1 || got[0] != host {
+			t.Fatalf("%s: streams to %q, want one to %s", tt.name, got, host)
+		}
+	}
+}
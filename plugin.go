@@ -6,54 +6,69 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-var pluginCmd *exec.Cmd
+// A pluginProc is a running SIP003 plugin.
+type pluginProc struct {
+	cmd      *exec.Cmd
+	done     chan struct{} // closed once the plugin exits
+	stopping atomic.Bool   // a plugin exiting on its own takes the process down
+}
+
+var plugins struct {
+	sync.Mutex
+	procs map[*pluginProc]struct{}
+}
 
-func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr string, err error) {
-	logf("starting plugin (%s) with option (%s)....", plugin, pluginOpts)
+func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr string, p *pluginProc, err error) {
+	logger.Info("starting plugin", "plugin", plugin, "opts", pluginOpts)
 	freePort, err := getFreePort()
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch an unused port for plugin (%v)", err)
+		return "", nil, fmt.Errorf("failed to fetch an unused port for plugin (%v)", err)
 	}
 	localHost := "127.0.0.1"
 	ssHost, ssPort, err := net.SplitHostPort(ssAddr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	newAddr = localHost + ":" + freePort
 	if isServer {
 		if ssHost == "" {
 			ssHost = "0.0.0.0"
 		}
-		logf("plugin (%s) will listen on %s:%s", plugin, ssHost, ssPort)
+		logger.Info("plugin will listen", "plugin", plugin, "addr", net.JoinHostPort(ssHost, ssPort))
 	} else {
-		logf("plugin (%s) will listen on %s:%s", plugin, localHost, freePort)
+		logger.Info("plugin will listen", "plugin", plugin, "addr", newAddr)
 	}
-	err = execPlugin(plugin, pluginOpts, ssHost, ssPort, localHost, freePort)
+	p, err = execPlugin(plugin, pluginOpts, ssHost, ssPort, localHost, freePort)
 	return
 }
 
+// stopPlugin terminates p, killing it if it does not exit in time.
+func stopPlugin(p *pluginProc) {
+	p.stopping.Store(true)
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	timeout := time.After(3 * time.Second)
+	select {
+	case <-p.done:
+	case <-timeout:
+		p.cmd.Process.Kill()
+	}
+}
+
 func killPlugin() {
-	if pluginCmd != nil {
-		pluginCmd.Process.Signal(syscall.SIGTERM)
-		waitCh := make(chan struct{})
-		go func() {
-			pluginCmd.Wait()
-			close(waitCh)
-		}()
-		timeout := time.After(3 * time.Second)
-		select {
-		case <-waitCh:
-		case <-timeout:
-			pluginCmd.Process.Kill()
-		}
+	plugins.Lock()
+	defer plugins.Unlock()
+	for p := range plugins.procs {
+		stopPlugin(p)
 	}
 }
 
-func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort string) (err error) {
+func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort string) (p *pluginProc, err error) {
 	pluginFile := plugin
 	if fileExists(plugin) {
 		if !filepath.IsAbs(plugin) {
@@ -62,10 +77,10 @@ func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort
 	} else {
 		pluginFile, err = exec.LookPath(plugin)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	logH := newLogHelper("[" + plugin + "]: ")
+	logH := newLogHelper(plugin)
 	env := append(os.Environ(),
 		"SS_REMOTE_HOST="+remoteHost,
 		"SS_REMOTE_PORT="+remotePort,
@@ -80,18 +95,33 @@ func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort
 		Stderr: logH,
 	}
 	if err = cmd.Start(); err != nil {
-		return err
+		return nil, err
+	}
+	p = &pluginProc{cmd: cmd, done: make(chan struct{})}
+	plugins.Lock()
+	if plugins.procs == nil {
+		plugins.procs = make(map[*pluginProc]struct{})
 	}
-	pluginCmd = cmd
+	plugins.procs[p] = struct{}{}
+	plugins.Unlock()
 	go func() {
-		if err := cmd.Wait(); err != nil {
-			logf("plugin exited (%v)\n", err)
+		err := cmd.Wait()
+		close(p.done)
+		plugins.Lock()
+		delete(plugins.procs, p)
+		plugins.Unlock()
+		if p.stopping.Load() {
+			logger.Info("plugin stopped", "plugin", plugin)
+			return
+		}
+		if err != nil {
+			logger.Error("plugin exited", "plugin", plugin, "err", err)
 			os.Exit(2)
 		}
-		logf("plugin exited\n")
+		logger.Error("plugin exited", "plugin", plugin)
 		os.Exit(0)
 	}()
-	return nil
+	return p, nil
 }
 
 func fileExists(filename string) bool {
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quotaConfig is a transfer quota of a user, of payload bytes in both
+// directions.
+type quotaConfig struct {
+	Bytes  int64  `json:"bytes"`
+	Period string `json:"period"` // "day" or "month" (the default), in local time
+}
+
+func (q *quotaConfig) validate() error {
+	if q == nil {
+		return nil
+	}
+	if q.Bytes <= 0 {
+		return errors.New("bytes must be positive")
+	}
+	if q.Period != "" && q.Period != "day" && q.Period != "month" {
+		return fmt.Errorf("period %q: want day or month", q.Period)
+	}
+	return nil
+}
+
+// A quota tracks the usage of a user in the current period.
+type quota struct {
+	ctr      counter // bytes since base
+	exceeded atomic.Bool
+	relays   tracker // cut once exceeded
+
+	mu     sync.Mutex
+	limit  int64  // 0 for none
+	period string // "day" or "month"
+	key    string // of the period counted, like 2026-10 or 2026-10-18
+	base   int64  // usage loaded from the quota file
+}
+
+// quotaUsage is the usage of a user in the quota file.
+type quotaUsage struct {
+	Period string `json:"period"`
+	Used   int64  `json:"used"`
+}
+
+// quotas are the quotas of users, their limits set by apply.
+var quotas struct {
+	sync.Mutex
+	users map[string]*quota
+}
+
+func periodKey(period string, t time.Time) string {
+	if period == "day" {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01")
+}
+
+// used returns the usage of q in its period. q.mu must be held.
+func (q *quota) used() int64 {
+	return q.base + q.ctr.up.Load() + q.ctr.down.Load()
+}
+
+// quotaOf returns the quota of user, or nil if user is empty as for servers
+// with a single user.
+func quotaOf(user string) *quota {
+	if user == "" {
+		return nil
+	}
+	quotas.Lock()
+	defer quotas.Unlock()
+	if quotas.users == nil {
+		quotas.users = make(map[string]*quota)
+	}
+	q := quotas.users[user]
+	if q == nil {
+		q = &quota{period: "month", key: periodKey("month", time.Now())}
+		quotas.users[user] = q
+	}
+	return q
+}
+
+// enter checks that q is not exceeded, then tracks c, a relay of its user,
+// to cut once it is until done is called. A nil q is never exceeded.
+func (q *quota) enter(c io.Closer) (done func(), ok bool) {
+	if q == nil {
+		return func() {}, true
+	}
+	if q.exceeded.Load() {
+		return nil, false
+	}
+	return q.relays.track(c), true
+}
+
+// setQuotas sets the quotas of the users of the servers of c, leaving the
+// other users without.
+func (c *fileConfig) setQuotas() {
+	configs := make(map[string]*quotaConfig)
+	for _, s := range c.Servers {
+		for _, u := range s.userConfigs {
+			if u.Quota != nil {
+				configs[u.Name] = u.Quota
+				quotaOf(u.Name)
+			}
+		}
+	}
+
+	quotas.Lock()
+	for user, q := range quotas.users {
+		qc := configs[user]
+		if qc == nil {
+			qc = new(quotaConfig)
+		}
+		q.mu.Lock()
+		q.limit, q.period = qc.Bytes, cmp.Or(qc.Period, "month")
+		q.mu.Unlock()
+	}
+	quotas.Unlock()
+	checkQuotas()
+}
+
+// checkQuotas starts new periods of quotas, and cuts the relays of users
+// who exceeded theirs.
+func checkQuotas() {
+	now := time.Now()
+	quotas.Lock()
+	defer quotas.Unlock()
+	for user, q := range quotas.users {
+		q.mu.Lock()
+		if k := periodKey(q.period, now); k != q.key {
+			q.key, q.base = k, 0
+			q.ctr.up.Store(0)
+			q.ctr.down.Store(0)
+		}
+		limit := q.limit
+		over := limit > 0 && q.used() >= limit
+		q.mu.Unlock()
+
+		if !over {
+			if q.exceeded.Swap(false) {
+				logger.Info("quota renewed", "user", user)
+			}
+			continue
+		}
+		if !q.exceeded.Swap(true) {
+			logger.Warn("quota exceeded", "user", user, "quota", limit)
+		}
+		if n := q.relays.cut(); n > 0 {
+			logger.Info("cut relays over quota", "user", user, "count", n)
+		}
+	}
+}
+
+// watchQuotas checks quotas every second, saving their usage to path, if
+// any, every minute.
+func watchQuotas(path string) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for i := 1; ; i++ {
+		<-t.C
+		checkQuotas()
+		if path != "" && i%60 == 0 {
+			if err := saveQuotas(path); err != nil {
+				logger.Error("failed to save quota usage", "err", err)
+			}
+		}
+	}
+}
+
+// loadQuotas reads the usage of users from path, if it exists.
+func loadQuotas(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var usage map[string]quotaUsage
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for user, u := range usage {
+		q := quotaOf(user)
+		q.mu.Lock()
+		q.key, q.base = u.Period, u.Used
+		q.mu.Unlock()
+	}
+	return nil
+}
+
+// saveQuotas writes the usage of users to path, replacing it atomically.
+func saveQuotas(path string) error {
+	quotas.Lock()
+	usage := make(map[string]quotaUsage, len(quotas.users))
+	for user, q := range quotas.users {
+		q.mu.Lock()
+		usage[user] = quotaUsage{q.key, q.used()}
+		q.mu.Unlock()
+	}
+	quotas.Unlock()
+
+	b, err := json.MarshalIndent(usage, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
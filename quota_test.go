@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeriodKey(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	for _, tt := range []struct {
+		period string
+		t      time.Time
+		want   string
+	}{
+		{"month", time.Date(2026, 10, 31, 23, 59, 59, 0, loc), "2026-10"},
+		{"month", time.Date(2026, 11, 1, 0, 0, 0, 0, loc), "2026-11"},
+		{"month", time.Date(2026, 12, 31, 23, 59, 59, 0, loc), "2026-12"},
+		{"month", time.Date(2027, 1, 1, 0, 0, 0, 0, loc), "2027-01"},
+		{"day", time.Date(2026, 10, 18, 23, 59, 59, 0, loc), "2026-10-18"},
+		{"day", time.Date(2026, 10, 19, 0, 0, 0, 0, loc), "2026-10-19"},
+		{"day", time.Date(2028, 2, 29, 12, 0, 0, 0, loc), "2028-02-29"},
+		{"", time.Date(2026, 10, 18, 0, 0, 0, 0, loc), "2026-10"},
+		// still the 31st in UTC, but a new day and month in local time
+		{"day", time.Date(2026, 11, 1, 0, 30, 0, 0, loc), "2026-11-01"},
+		{"month", time.Date(2026, 11, 1, 0, 30, 0, 0, loc), "2026-11"},
+		{"day", time.Date(2026, 11, 1, 0, 30, 0, 0, loc).UTC(), "2026-10-31"},
+	} {
+		if got := periodKey(tt.period, tt.t); got != tt.want {
+			t.Errorf("periodKey(%q, %v) = %q, want %q", tt.period, tt.t, got, tt.want)
+		}
+	}
+}
+
+// withQuotas sets the quotas of users for the rest of the test.
+func withQuotas(t *testing.T, users map[string]*quota) {
+	saved := quotas.users
+	quotas.users = users
+	t.Cleanup(func() { quotas.users = saved })
+}
+
+func TestQuotaPeriod(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		period, key string
+		base        int64
+		exceeded    bool
+	}{
+		{"month", periodKey("month", now), 100, true},
+		{"month", periodKey("month", now), 99, false},
+		{"month", periodKey("month", now.AddDate(0, -1, 0)), 100, false},
+		{"day", periodKey("day", now), 100, true},
+		{"day", periodKey("day", now.AddDate(0, 0, -1)), 100, false},
+		{"day", periodKey("month", now), 100, false}, // period changed
+	} {
+		q := &quota{limit: 100, period: tt.period, key: tt.key, base: tt.base}
+		q.exceeded.Store(!tt.exceeded)
+		withQuotas(t, map[string]*quota{"alice": q})
+		checkQuotas()
+		if q.exceeded.Load() != tt.exceeded {
+			t.Errorf("Quota of %d bytes of %s %s exceeded: %v, want %v", tt.base, tt.period, tt.key, q.exceeded.Load(), tt.exceeded)
+		}
+		if want := periodKey(tt.period, now); q.key != want {
+			t.Errorf("Quota of %s %s counts %s, want %s", tt.period, tt.key, q.key, want)
+		}
+	}
+}
+
+func TestQuotaSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := loadQuotas(path); err != nil {
+		t.Fatalf("Missing quota file: %v", err)
+	}
+
+	alice := &quota{period: "month", key: "2026-10", base: 70}
+	alice.ctr.up.Store(20)
+	alice.ctr.down.Store(10)
+	bob := &quota{period: "day", key: "2026-10-18"}
+	withQuotas(t, map[string]*quota{"alice": alice, "bob": bob})
+	if err := saveQuotas(path); err != nil {
+		t.Fatal(err)
+	}
+
+	quotas.users = nil
+	if err := loadQuotas(path); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string]quotaUsage{"alice": {"2026-10", 100}, "bob": {"2026-10-18", 0}} {
+		q := quotas.users[user]
+		if q == nil {
+			t.Fatalf("Quota of %s not loaded", user)
+		}
+		if got := (quotaUsage{q.key, q.used()}); got != want {
+			t.Errorf("Quota of %s loaded as %+v, want %+v", user, got, want)
+		}
+	}
+}
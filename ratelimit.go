@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit is a limit of bytes per second from clients to targets (up) and
+// back (down); 0 for none.
+type rateLimit struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+func (r *rateLimit) validate() error {
+	if r != nil && (r.Up < 0 || r.Down < 0) {
+		return errors.New("rates must not be negative")
+	}
+	return nil
+}
+
+// A limiter is a token bucket of bytes, filling at its rate up to a second
+// worth of bytes. Its rate can change while in use.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second; 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	l.tokens = min(l.tokens, l.rate)
+}
+
+// fill adds the tokens earned since last time. l.mu must be held.
+func (l *limiter) fill() {
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+}
+
+// reserve takes n bytes, going into debt if short, and returns how long to
+// wait before passing them.
+func (l *limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.fill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow reports whether n bytes may pass now, taking them if so.
+func (l *limiter) allow(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	l.fill()
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// limiters are the limiters traffic in one direction passes, such as the
+// global one and those of its port and user.
+type limiters []*limiter
+
+// wait takes n bytes from each of ls, sleeping until they may pass.
+func (ls limiters) wait(n int) {
+	var d time.Duration
+	for _, l := range ls {
+		d = max(d, l.reserve(n))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// allow reports whether n bytes may pass all of ls now, taking them if so.
+func (ls limiters) allow(n int) bool {
+	for i, l := range ls {
+		if !l.allow(n) {
+			for _, l := range ls[:i] { // give back
+				l.reserve(-n)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// A limiterPair limits both directions.
+type limiterPair struct{ up, down limiter }
+
+// limits are the limiters of servers, their rates set by apply.
+var limits struct {
+	sync.Mutex
+	global limiterPair
+	ports  map[int]*limiterPair
+	users  map[string]*limiterPair
+}
+
+// setLimits sets the rates of the limiters from the servers of c, leaving
+// ports and users without a limit unlimited.
+func (c *fileConfig) setLimits() {
+	ports := make(map[int]*rateLimit)
+	users := make(map[string]*rateLimit)
+	for _, s := range c.Servers {
+		if s.RateLimit != nil {
+			_, port, _ := net.SplitHostPort(s.Address)
+			n, _ := strconv.Atoi(port)
+			ports[n] = s.RateLimit
+		}
+		for _, u := range s.userConfigs {
+			if u.RateLimit != nil {
+				users[u.Name] = u.RateLimit
+			}
+		}
+	}
+
+	limits.Lock()
+	defer limits.Unlock()
+	set := func(p *limiterPair, r *rateLimit) {
+		if r == nil {
+			r = new(rateLimit)
+		}
+		p.up.setRate(r.Up)
+		p.down.setRate(r.Down)
+	}
+	set(&limits.global, c.RateLimit)
+	for port, p := range limits.ports {
+		set(p, ports[port])
+	}
+	for user, p := range limits.users {
+		set(p, users[user])
+	}
+	for port, r := range ports {
+		if limits.ports[port] == nil {
+			set(pairOf(&limits.ports, port), r)
+		}
+	}
+	for user, r := range users {
+		if limits.users[user] == nil {
+			set(pairOf(&limits.users, user), r)
+		}
+	}
+}
+
+// pairOf returns the limiterPair of k in *m, adding one if missing.
+// limits must be locked.
+func pairOf[K comparable](m *map[K]*limiterPair, k K) *limiterPair {
+	if *m == nil {
+		*m = make(map[K]*limiterPair)
+	}
+	p := (*m)[k]
+	if p == nil {
+		p = new(limiterPair)
+		(*m)[k] = p
+	}
+	return p
+}
+
+// connLimiters returns the limiters of a connection on the port of addr from
+// user, which is empty if the server has a single user.
+func connLimiters(addr net.Addr, user string) (up, down limiters) {
+	limits.Lock()
+	defer limits.Unlock()
+	pairs := []*limiterPair{&limits.global, pairOf(&limits.ports, addrPort(addr))}
+	if user != "" {
+		pairs = append(pairs, pairOf(&limits.users, user))
+	}
+	for _, p := range pairs {
+		up = append(up, &p.up)
+		down = append(down, &p.down)
+	}
+	return up, down
+}
+
+// limitedConn is a connection to a target limited in both directions.
+type limitedConn struct {
+	net.Conn
+	up, down limiters
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.down.wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.up.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// limitedPacketConn is a UDP session with targets dropping packets beyond
+// the limits in both directions.
+type limitedPacketConn struct {
+	net.PacketConn
+	up, down limiters
+}
+
+func (c *limitedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || c.down.allow(n) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *limitedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.up.allow(len(b)) {
+		return 0, nil // dropped
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
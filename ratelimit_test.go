@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	var l limiter
+	l.setRate(1000)
+	l.last = time.Now().Add(-10 * time.Second) // idle long enough for ten seconds' worth
+	if !l.allow(1000) {
+		t.Fatal("A second's worth of bytes denied after idling")
+	}
+	if l.allow(100) {
+		t.Fatal("Burst went past a second's worth of bytes")
+	}
+	if d := l.reserve(500); d < 400*time.Millisecond || d > 600*time.Millisecond {
+		t.Fatalf("Reserving half a second's worth when out waits %v", d)
+	}
+
+	// lowering the rate drops the tokens past a second's worth of it
+	l.setRate(0)
+	if !l.allow(1 << 20) {
+		t.Fatal("Bytes denied without a limit")
+	}
+	l.last = time.Now().Add(-10 * time.Second)
+	l.setRate(100)
+	if l.allow(101) {
+		t.Fatal("Burst went past a second's worth of the new rate")
+	}
+}
+
+func TestLimitedConnWait(t *testing.T) {
+	var up limiter
+	up.setRate(100000)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	c := &limitedConn{Conn: a, up: limiters{&up}}
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 100000)); err != nil { // the burst
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Write of the burst took %v", d)
+	}
+	if _, err := c.Write(make([]byte, 20000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("Write past the burst took %v, want about 200ms", d)
+	}
+}
+
+func TestLimitedPacketConnDrop(t *testing.T) {
+	listen := func() net.PacketConn {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	var up, down limiter
+	up.setRate(100)
+	down.setRate(100)
+	peer := listen()
+	c := &limitedPacketConn{PacketConn: listen(), up: limiters{&up}, down: limiters{&down}}
+
+	for i, want := range []int{100, 0} {
+		if n, err := c.WriteTo(make([]byte, 100), peer.LocalAddr()); n != want || err != nil {
+			t.Fatalf("Packet %d written: %d, %v, want %d", i, n, err, want)
+		}
+	}
+	b := make([]byte, 1024)
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := peer.ReadFrom(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := peer.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Packet over the limit sent: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		peer.WriteTo(make([]byte, 100), c.LocalAddr())
+	}
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := c.ReadFrom(b); n != 100 || err != nil {
+		t.Fatalf("Packet read: %d, %v", n, err)
+	}
+	if _, _, err := c.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Packet over the limit read: %v", err)
+	}
+}
+
+func TestSetLimitsOpenRelays(t *testing.T) {
+	saved := limits.ports
+	limits.ports = nil
+	t.Cleanup(func() {
+		limits.ports = saved
+		limits.global.up.setRate(0)
+		limits.global.down.setRate(0)
+	})
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8488}
+	cfg := &fileConfig{
+		RateLimit: &rateLimit{Up: 1000},
+		Servers:   []serverConfig{{Address: ":8488", RateLimit: &rateLimit{Up: 100, Down: 200}}},
+	}
+	cfg.setLimits()
+	up, down := connLimiters(addr, "")
+	if len(up) != 2 || up[0].rate != 1000 || up[1].rate != 100 || down[1].rate != 200 {
+		t.Fatalf("Limits of a relay: up %v/%v, down %v", up[0].rate, up[1].rate, down[1].rate)
+	}
+
+	// the relay open keeps its limiters, which take the new rates
+	cfg.RateLimit = nil
+	cfg.Servers[0].RateLimit = &rateLimit{Up: 300}
+	cfg.setLimits()
+	if up[0].rate != 0 || up[1].rate != 300 || down[1].rate != 0 {
+		t.Fatalf("Limits of a relay after a change: up %v/%v, down %v", up[0].rate, up[1].rate, down[1].rate)
+	}
+	cfg.Servers = nil
+	cfg.setLimits()
+	if up[1].rate != 0 {
+		t.Fatalf("Limit of a relay of a port without one: %v", up[1].rate)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// saltFilterConfig sizes the salt filters against replays of a server, one
+// for each of its users, who split the capacity evenly. Fields left out take
+// the SHADOWSOCKS_SF_* settings.
+type saltFilterConfig struct {
+	Capacity *int    `json:"capacity"` // salts remembered; 0 disables
+	FPR      float64 `json:"fpr"`      // false positive rate
+	Slots    int     `json:"slots"`    // parts of the capacity forgotten at a time once full
+}
+
+type saltFilterSize struct {
+	capacity int
+	fpr      float64
+	slots    int
+}
+
+func (c *saltFilterConfig) size() saltFilterSize {
+	capacity, fpr, slots, _ := shadowaead.SaltFilterSettings()
+	if c != nil {
+		if c.Capacity != nil {
+			capacity = *c.Capacity
+		}
+		fpr = cmp.Or(c.FPR, fpr)
+		slots = cmp.Or(c.Slots, slots)
+	}
+	return saltFilterSize{capacity, fpr, slots}
+}
+
+// share returns the size of the filter of each of n users of a server of
+// size z, keeping enough capacity for a salt per slot.
+func (z saltFilterSize) share(n int) saltFilterSize {
+	if n > 1 && z.capacity > 0 {
+		z.capacity = max(z.capacity/n, z.slots)
+	}
+	return z
+}
+
+func (c *saltFilterConfig) validate() error {
+	z := c.size()
+	_, err := shadowaead.NewSaltFilter(z.capacity, z.fpr, z.slots)
+	return err
+}
+
+// A saltFilterEntry is the salt filter of a port and user.
+type saltFilterEntry struct {
+	filter *shadowaead.SaltFilter
+	size   saltFilterSize // of the server, before it is shared among users
+	port   int
+	user   string // empty for servers with a single user
+}
+
+// restore restores the filter of e from the snapshot b.
+func (e *saltFilterEntry) restore(b []byte) {
+	if err := e.filter.UnmarshalBinary(b); err != nil {
+		logger.Warn("starting with an empty salt filter", "port", e.port, "user", e.user, "err", err)
+	}
+}
+
+// saltFilters are the salt filters of servers by ID, the port and user, kept
+// across reloads so that they remember salts seen before, and shared by the
+// ciphers of a port on several hosts.
+var saltFilters struct {
+	sync.Mutex
+	entries map[string]*saltFilterEntry
+	saved   map[string][]byte // snapshots from the salt file, restored on first use
+}
+
+// withSaltFilter returns ciph with the salt filter of user of s, one of
+// users, and records its ID in s. Users keep their filters as others come
+// and go, and only new ones get a share of the capacity as it is then.
+func (s *serverConfig) withSaltFilter(ciph core.Cipher, user string, users int) (core.Cipher, error) {
+	_, p, _ := net.SplitHostPort(s.Address)
+	port, _ := strconv.Atoi(p)
+	id := p + "/" + user
+	z := s.SaltFilter.size()
+
+	saltFilters.Lock()
+	defer saltFilters.Unlock()
+	e := saltFilters.entries[id]
+	if e == nil || e.size != z {
+		share := z.share(users)
+		f, err := shadowaead.NewSaltFilter(share.capacity, share.fpr, share.slots)
+		if err != nil {
+			return nil, fmt.Errorf("salt_filter: %v", err)
+		}
+		e = &saltFilterEntry{f, z, port, user}
+		if b := saltFilters.saved[id]; b != nil {
+			delete(saltFilters.saved, id)
+			e.restore(b)
+		}
+		if saltFilters.entries == nil {
+			saltFilters.entries = make(map[string]*saltFilterEntry)
+		}
+		saltFilters.entries[id] = e
+	}
+	s.saltFilters = append(s.saltFilters, id)
+	return core.SaltFilterCipher(ciph, e.filter)
+}
+
+// keepSaltFilters drops the salt filters no server of c uses. Snapshots not
+// restored are kept for ports and users added later, as by the manager.
+func (c *fileConfig) keepSaltFilters() {
+	keep := make(map[string]bool)
+	for _, s := range c.Servers {
+		for _, id := range s.saltFilters {
+			keep[id] = true
+		}
+	}
+	saltFilters.Lock()
+	defer saltFilters.Unlock()
+	for id := range saltFilters.entries {
+		if !keep[id] {
+			delete(saltFilters.entries, id)
+		}
+	}
+}
+
+// saltFilterStat is the statistics of the salt filter of a port and user.
+type saltFilterStat struct {
+	port int
+	user string
+	shadowaead.SaltFilterStats
+}
+
+// saltFilterStats returns the statistics of the salt filters in use, by
+// port and user.
+func saltFilterStats() []saltFilterStat {
+	saltFilters.Lock()
+	defer saltFilters.Unlock()
+	var stats []saltFilterStat
+	for _, e := range saltFilters.entries {
+		if e.filter != nil {
+			stats = append(stats, saltFilterStat{e.port, e.user, e.filter.Stats()})
+		}
+	}
+	slices.SortFunc(stats, func(a, b saltFilterStat) int {
+		return cmp.Or(cmp.Compare(a.port, b.port), cmp.Compare(a.user, b.user))
+	})
+	return stats
+}
+
+// The salt file holds a snapshot of each salt filter: the magic and a
+// version byte, then for each filter its ID after its big-endian uint16
+// length and the snapshot after its big-endian uint32 length, and last a
+// CRC-32 (IEEE) of all that precedes it.
+const (
+	saltFileMagic   = "SSSF"
+	saltFileVersion = 1
+)
+
+var errSaltFileCorrupt = errors.New("salt file corrupt")
+
+// loadSaltFilters restores the salt filters in use from their snapshots in
+// path, if it exists, keeping the others for filters put to use later.
+func loadSaltFilters(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n := len(b) - 4
+	if n < len(saltFileMagic)+1 || string(b[:len(saltFileMagic)]) != saltFileMagic ||
+		crc32.ChecksumIEEE(b[:n]) != binary.BigEndian.Uint32(b[n:]) {
+		return fmt.Errorf("%s: %w", path, errSaltFileCorrupt)
+	}
+	if v := b[len(saltFileMagic)]; v != saltFileVersion {
+		return fmt.Errorf("%s: unknown version %d", path, v)
+	}
+	saved := make(map[string][]byte)
+	for p := b[len(saltFileMagic)+1 : n]; len(p) > 0; {
+		if len(p) < 2 || len(p) < 2+int(binary.BigEndian.Uint16(p))+4 {
+			return fmt.Errorf("%s: %w", path, errSaltFileCorrupt)
+		}
+		id := string(p[2 : 2+binary.BigEndian.Uint16(p)])
+		p = p[2+len(id):]
+		size := binary.BigEndian.Uint32(p)
+		if uint64(len(p)-4) < uint64(size) {
+			return fmt.Errorf("%s: %w", path, errSaltFileCorrupt)
+		}
+		saved[id] = p[4 : 4+size]
+		p = p[4+size:]
+	}
+
+	saltFilters.Lock()
+	defer saltFilters.Unlock()
+	for id, e := range saltFilters.entries {
+		if b := saved[id]; b != nil {
+			delete(saved, id)
+			e.restore(b)
+		}
+	}
+	saltFilters.saved = saved
+	return nil
+}
+
+// saveSaltFilters writes snapshots of the salt filters in use to path,
+// along with those loaded and not restored yet, replacing it atomically.
+func saveSaltFilters(path string) error {
+	saltFilters.Lock()
+	entries := make(map[string]*shadowaead.SaltFilter, len(saltFilters.entries))
+	for id, e := range saltFilters.entries {
+		if e.filter != nil {
+			entries[id] = e.filter
+		}
+	}
+	snaps := make(map[string][]byte, len(saltFilters.saved))
+	for id, snap := range saltFilters.saved {
+		snaps[id] = snap
+	}
+	saltFilters.Unlock()
+
+	for id, f := range entries {
+		snap, err := f.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if snap != nil { // used
+			snaps[id] = snap
+		}
+	}
+	b := append([]byte(saltFileMagic), saltFileVersion)
+	for id, snap := range snaps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(id)))
+		b = append(b, id...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(snap)))
+		b = append(b, snap...)
+	}
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// watchSaltFilters saves the salt filters to path every minute.
+func watchSaltFilters(path string) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		if err := saveSaltFilters(path); err != nil {
+			logger.Error("failed to save salt filters", "err", err)
+		}
+	}
+}
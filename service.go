@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// A cipherSwitch is a core.Cipher whose underlying cipher is swapped on
+// reloads. Connections keep the cipher current when they were wrapped.
+type cipherSwitch struct{ p atomic.Pointer[core.Cipher] }
+
+func (s *cipherSwitch) Load() core.Cipher   { return *s.p.Load() }
+func (s *cipherSwitch) Store(c core.Cipher) { s.p.Store(&c) }
+
+func (s *cipherSwitch) StreamConn(c net.Conn) net.Conn { return s.Load().StreamConn(c) }
+func (s *cipherSwitch) PacketConn(c net.PacketConn) net.PacketConn {
+	return s.Load().PacketConn(c)
+}
+
+// proxySettings are the settings of a proxy listener that reloads change
+// for new connections.
+type proxySettings struct {
+	creds credentials // of the clients, nil if they need not authenticate
+	udp   bool        // UDP ASSOCIATE supported, for SOCKS5
+}
+
+// proxies holds the settings of proxy listeners by address.
+var proxies atomic.Pointer[map[string]proxySettings]
+
+// proxySettingsOf returns the settings of the proxy listener on local, as of
+// the last reload.
+func proxySettingsOf(local string) func() proxySettings {
+	return func() proxySettings {
+		if m := proxies.Load(); m != nil {
+			return (*m)[local]
+		}
+		return proxySettings{}
+	}
+}
+
+// A service is a listener started from the configuration. It keeps running
+// across reloads as long as its key stays in the configuration.
+type service struct {
+	ciph *cipherSwitch
+	l    io.Closer
+}
+
+// A serviceSpec describes a service to run. The key holds everything the
+// service is started with, except the cipher which can be swapped.
+type serviceSpec struct {
+	key   string
+	ciph  core.Cipher
+	start func(ciph *cipherSwitch) (io.Closer, error)
+	wake  bool // wake up blocked reads on swaps, for UDP servers which wrap their socket per cipher
+}
+
+// A pluginKey identifies a plugin of a server across reloads.
+type pluginKey struct {
+	server             bool
+	addr               string
+	plugin, pluginOpts string
+}
+
+// Running services and plugins, only touched with managed locked.
+var (
+	services       = make(map[string]*service)
+	runningPlugins = make(map[pluginKey]pluginRun)
+)
+
+type pluginRun struct {
+	addr string // address the plugin listens on for us, or forwards to
+	proc *pluginProc
+}
+
+// apply makes the running services and plugins those of c: services gone
+// from c stop listening, new ones start, and the others keep running with
+// their cipher swapped for new connections. Connections in progress are left
+// alone. Services which fail to start are reported in the error.
+func (c *fileConfig) apply() error {
+	var errs []error
+
+	// plugins go first since services connect to them; those gone from c
+	// stop first as new ones may take over their addresses
+	wantPlugins := make(map[pluginKey]bool)
+	for _, s := range c.Servers {
+		if s.Plugin != "" {
+			wantPlugins[pluginKey{c.Role == "server", s.Address, s.Plugin, s.PluginOpts}] = true
+		}
+	}
+	stopped := make(map[string]bool) // addresses of plugins stopped, restarted if started again
+	for k, p := range runningPlugins {
+		if !wantPlugins[k] {
+			stopPlugin(p.proc)
+			delete(runningPlugins, k)
+			stopped[k.addr] = true
+		}
+	}
+	tcpAddr := make(map[*serverConfig]string) // address to connect to or listen on for TCP
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		tcpAddr[s] = s.Address
+		if s.Plugin == "" {
+			continue
+		}
+		k := pluginKey{c.Role == "server", s.Address, s.Plugin, s.PluginOpts}
+		if p, ok := runningPlugins[k]; ok {
+			tcpAddr[s] = p.addr
+			continue
+		}
+		addr, p, err := startPlugin(s.Plugin, s.PluginOpts, s.Address, k.server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s of %s: %v", s.Plugin, s.Address, err))
+			delete(tcpAddr, s)
+			continue
+		}
+		runningPlugins[k] = pluginRun{addr, p}
+		if stopped[s.Address] {
+			metrics.pluginRestarts.Add(1)
+		}
+		tcpAddr[s] = addr
+	}
+
+	c.keepSaltFilters()
+	var specs []serviceSpec
+	if c.Role == "server" {
+		outbound.Store(c.acl)
+		inbound.Store(c.policy)
+		fallback.Store(&c.Fallback)
+		c.setLimits()
+		c.setQuotas()
+		for i := range c.Servers {
+			s := &c.Servers[i]
+			if addr, ok := tcpAddr[s]; ok && hasTCP(s.Mode) {
+				specs = append(specs, serviceSpec{"tcp " + addr, s.ciph, func(ciph *cipherSwitch) (io.Closer, error) {
+					l, err := net.Listen("tcp", addr)
+					if err == nil {
+						go tcpRemote(l, ciph.StreamConn)
+					}
+					return l, err
+				}, false})
+			}
+			if hasUDP(s.Mode) {
+				specs = append(specs, serviceSpec{"udp " + s.Address, s.ciph, func(ciph *cipherSwitch) (io.Closer, error) {
+					c, err := listenUDP(s.Address)
+					if err == nil {
+						go udpRemote(c, ciph)
+					}
+					return c, err
+				}, true})
+			}
+		}
+	}
+
+	for _, t := range c.Tunnels {
+		server, remote := t.srv.Address, t.Remote
+		if addr, ok := tcpAddr[t.srv]; ok && hasTCP(t.Mode) {
+			specs = append(specs, serviceSpec{"tcptun " + t.Local + " " + addr + " " + remote, t.srv.ciph, func(ciph *cipherSwitch) (io.Closer, error) {
+				l, err := net.Listen("tcp", t.Local)
+				if err == nil {
+					go tcpTun(l, addr, remote, ciph.StreamConn)
+				}
+				return l, err
+			}, false})
+		}
+		if hasUDP(t.Mode) {
+			specs = append(specs, serviceSpec{"udptun " + t.Local + " " + server + " " + remote, t.srv.ciph, func(ciph *cipherSwitch) (io.Closer, error) {
+				c, err := listenUDP(t.Local)
+				if err == nil {
+					go udpLocal(c, server, remote, ciph.PacketConn)
+				}
+				return c, err
+			}, false})
+		}
+	}
+
+	ps := make(map[string]proxySettings)
+	for _, l := range c.Listeners {
+		ps[l.Address] = proxySettings{l.creds, l.UDP}
+	}
+	proxies.Store(&ps)
+
+	for _, l := range c.Listeners {
+		local, server := l.Address, l.srv.Address
+		addr, ok := tcpAddr[l.srv]
+		if !ok {
+			continue
+		}
+		loop := map[string]func(net.Listener, string, func(net.Conn) net.Conn, func() proxySettings){
+			"socks": socksLocal,
+			"http":  httpLocal,
+			"mixed": mixedLocal,
+			"redir": func(l net.Listener, server string, shadow func(net.Conn) net.Conn, _ func() proxySettings) {
+				redirLocal(l, server, shadow)
+			},
+			"redir6": func(l net.Listener, server string, shadow func(net.Conn) net.Conn, _ func() proxySettings) {
+				redir6Local(l, server, shadow)
+			},
+		}[l.Type]
+		specs = append(specs, serviceSpec{l.Type + " " + local + " " + addr, l.srv.ciph, func(ciph *cipherSwitch) (io.Closer, error) {
+			ln, err := net.Listen("tcp", local)
+			if err == nil {
+				go loop(ln, addr, ciph.StreamConn, proxySettingsOf(local))
+			}
+			return ln, err
+		}, false})
+		if (l.Type == "socks" || l.Type == "mixed") && l.UDP {
+			specs = append(specs, serviceSpec{"udpsocks " + local + " " + server, l.srv.ciph, func(ciph *cipherSwitch) (io.Closer, error) {
+				c, err := listenUDP(local)
+				if err == nil {
+					go udpSocksLocal(c, server, ciph.PacketConn)
+				}
+				return c, err
+			}, false})
+		}
+	}
+
+	// stop services gone from c, freeing their addresses
+	want := make(map[string]bool)
+	for _, sp := range specs {
+		want[sp.key] = true
+	}
+	for k, svc := range services {
+		if !want[k] {
+			logger.Info("stopping", "service", k)
+			svc.l.Close()
+			delete(services, k)
+		}
+	}
+
+	for _, sp := range specs {
+		if svc, ok := services[sp.key]; ok {
+			svc.ciph.Store(sp.ciph)
+			if sp.wake {
+				svc.l.(*net.UDPConn).SetReadDeadline(time.Now())
+			}
+			continue
+		}
+		svc := &service{ciph: new(cipherSwitch)}
+		svc.ciph.Store(sp.ciph)
+		l, err := sp.start(svc.ciph)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", sp.key, err))
+			continue
+		}
+		svc.l = l
+		services[sp.key] = svc
+	}
+	return errors.Join(errs...)
+}
+
+// stopServices stops the running services listening on UDP, or those on TCP.
+func stopServices(udp bool) {
+	for k, svc := range services {
+		if _, ok := svc.l.(*net.UDPConn); ok == udp {
+			svc.l.Close()
+			delete(services, k)
+		}
+	}
+}
+
+func listenUDP(addr string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", laddr)
+}
@@ -5,16 +5,21 @@ import (
 	"crypto/cipher"
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
 )
 
 // ErrRepeatedSalt means detected a reused salt
 var ErrRepeatedSalt = errors.New("repeated salt detected")
 
+// ErrIdentityNotSupported means that a cipher does not support identity headers.
+var ErrIdentityNotSupported = errors.New("identity headers not supported")
+
 type Cipher interface {
 	KeySize() int
 	SaltSize() int
@@ -38,6 +43,7 @@ func hkdfSHA1(secret, salt, info, outkey []byte) {
 type metaCipher struct {
 	psk      []byte
 	makeAEAD func(key []byte) (cipher.AEAD, error)
+	filter   *SaltFilter
 }
 
 func (a *metaCipher) KeySize() int { return len(a.psk) }
@@ -74,7 +80,7 @@ func AESGCM(psk []byte) (Cipher, error) {
 	default:
 		return nil, aes.KeySizeError(l)
 	}
-	return &metaCipher{psk: psk, makeAEAD: aesGCM}, nil
+	return &metaCipher{psk: psk, makeAEAD: aesGCM, filter: DefaultSaltFilter()}, nil
 }
 
 // Chacha20Poly1305 creates a new Cipher with a pre-shared key. len(psk)
@@ -83,5 +89,147 @@ func Chacha20Poly1305(psk []byte) (Cipher, error) {
 	if len(psk) != chacha20poly1305.KeySize {
 		return nil, KeySizeError(chacha20poly1305.KeySize)
 	}
-	return &metaCipher{psk: psk, makeAEAD: chacha20poly1305.New}, nil
+	return &metaCipher{psk: psk, makeAEAD: chacha20poly1305.New, filter: DefaultSaltFilter()}, nil
+}
+
+// Cipher2022 is a Cipher for the SIP022 "2022-blake3" methods. Session
+// subkeys are derived with BLAKE3 and salts are as long as the key. Besides
+// the session subkeys, the pre-shared key itself protects the headers of UDP
+// packets, which is why Cipher2022 can only be created by this package.
+type Cipher2022 interface {
+	Cipher
+	blake3() *blake3Cipher
+}
+
+// ErrUnknownUser means that an identity header names no known user.
+var ErrUnknownUser = errors.New("unknown user")
+
+// A User is a named pre-shared key of a multi-user server.
+type User struct {
+	Name   string
+	Cipher Cipher
+}
+
+func blake3Subkey(psk, salt []byte, context string) []byte {
+	material := make([]byte, len(psk)+len(salt))
+	copy(material, psk)
+	copy(material[len(psk):], salt)
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, context, material)
+	return subkey
+}
+
+// pskHash returns the hash identifying psk in identity headers.
+func pskHash(psk []byte) (h [aes.BlockSize]byte) {
+	sum := blake3.Sum256(psk)
+	copy(h[:], sum[:])
+	return
+}
+
+// identity is an identity PSK sent by clients to multi-user servers. It is
+// followed in the chain by the PSK of the next hop, or by the user PSK.
+type identity struct {
+	psk   []byte
+	block cipher.Block
+	next  [aes.BlockSize]byte // hash of the next PSK
+}
+
+type user2022 struct {
+	name string
+	ciph *blake3Cipher
+}
+
+type blake3Cipher struct {
+	psk      []byte
+	makeAEAD func(key []byte) (cipher.AEAD, error)
+	block    cipher.Block // encrypts separate headers of UDP packets
+	paead    cipher.AEAD  // seals whole UDP packets if block is nil
+	filter   *SaltFilter
+
+	identities []identity                       // client only
+	users      map[[aes.BlockSize]byte]user2022 // server only
+}
+
+func (a *blake3Cipher) KeySize() int  { return len(a.psk) }
+func (a *blake3Cipher) SaltSize() int { return len(a.psk) }
+func (a *blake3Cipher) Encrypter(salt []byte) (cipher.AEAD, error) {
+	return a.makeAEAD(blake3Subkey(a.psk, salt, "shadowsocks 2022 session subkey"))
+}
+func (a *blake3Cipher) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return a.makeAEAD(blake3Subkey(a.psk, salt, "shadowsocks 2022 session subkey"))
+}
+func (a *blake3Cipher) blake3() *blake3Cipher { return a }
+
+// Blake3AESGCM creates a new SIP022 Cipher with a pre-shared key. len(psk)
+// must be 16 or 32 to select 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm.
+func Blake3AESGCM(psk []byte) (Cipher2022, error) {
+	switch l := len(psk); l {
+	case 16, 32:
+	default:
+		return nil, aes.KeySizeError(l)
+	}
+	blk, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &blake3Cipher{psk: psk, makeAEAD: aesGCM, block: blk, filter: DefaultSaltFilter()}, nil
+}
+
+// Blake3Chacha20Poly1305 creates a new SIP022 Cipher with a pre-shared key.
+// len(psk) must be 32.
+func Blake3Chacha20Poly1305(psk []byte) (Cipher2022, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, KeySizeError(chacha20poly1305.KeySize)
+	}
+	paead, err := chacha20poly1305.NewX(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &blake3Cipher{psk: psk, makeAEAD: chacha20poly1305.New, paead: paead, filter: DefaultSaltFilter()}, nil
+}
+
+// WithIdentities returns a copy of ciph, a client Cipher2022 of a user PSK,
+// that sends an extensible identity header for each of the identity PSKs
+// ipsks, in the order they are given, to reach a multi-user server. Only
+// 2022-blake3-aes-*-gcm support identity headers.
+func WithIdentities(ciph Cipher2022, ipsks ...[]byte) (Cipher2022, error) {
+	a := *ciph.blake3()
+	if a.block == nil {
+		return nil, ErrIdentityNotSupported
+	}
+	a.identities = make([]identity, len(ipsks))
+	for i, psk := range ipsks {
+		if len(psk) != len(a.psk) {
+			return nil, KeySizeError(len(a.psk))
+		}
+		blk, err := aes.NewCipher(psk)
+		if err != nil {
+			return nil, err
+		}
+		next := a.psk
+		if i+1 < len(ipsks) {
+			next = ipsks[i+1]
+		}
+		a.identities[i] = identity{psk: psk, block: blk, next: pskHash(next)}
+	}
+	return &a, nil
+}
+
+// WithUsers returns a copy of ciph, a server Cipher2022 of an identity PSK,
+// that identifies the given users from extensible identity headers. Ciphers
+// of the users must be of the same method as ciph.
+func WithUsers(ciph Cipher2022, users []User) (Cipher2022, error) {
+	a := *ciph.blake3()
+	if a.block == nil {
+		return nil, ErrIdentityNotSupported
+	}
+	a.users = make(map[[aes.BlockSize]byte]user2022, len(users))
+	for _, u := range users {
+		uc, ok := u.Cipher.(Cipher2022)
+		if !ok || uc.blake3().KeySize() != a.KeySize() || uc.blake3().block == nil {
+			return nil, fmt.Errorf("user %s: cipher differs from server", u.Name)
+		}
+		a.users[pskHash(uc.blake3().psk)] = user2022{name: u.Name, ciph: uc.blake3()}
+	}
+	return &a, nil
 }
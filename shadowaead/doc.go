@@ -31,5 +31,26 @@ using zero nonce.
 
 In both stream-oriented and packet-oriented connections, length of nonce and tag varies
 depending on which AEAD is used. Salt should be at least 16-byte long.
+
+The SIP022 "2022-blake3" methods (see NewConn2022 and NewPacketConn2022) derive session subkeys
+with BLAKE3 and start every request and response with a header carrying its type and a timestamp,
+so that replayed and reflected messages are rejected. Payload length of their records is capped
+at 0xFFFF. A request stream has the following structure:
+
+    [salt]
+    [encrypted type, timestamp and variable-length header length][tag]
+    [encrypted target address, padding length, padding and initial payload][tag]
+    [encrypted records as above]
+
+and a response stream:
+
+    [salt]
+    [encrypted type, timestamp, request salt and first payload length][tag]
+    [encrypted first payload][tag]
+    [encrypted records as above]
+
+Packets carry a session ID and a packet ID in a separate header, which is encrypted with the
+pre-shared key by AES (or sealed together with the packet by XChaCha20-Poly1305 for
+2022-blake3-chacha20-poly1305). The session ID derives the subkey of the packet body.
 */
 package shadowaead
@@ -7,8 +7,6 @@ import (
 	"net"
 	"net/netip"
 	"sync"
-
-	"github.com/shadowsocks/go-shadowsocks2/internal"
 )
 
 // ErrShortPacket means that the packet is too short for a valid encrypted packet.
@@ -18,7 +16,8 @@ var _zerononce [128]byte // read-only. 128 bytes is more than enough.
 
 // Pack encrypts plaintext using Cipher with a randomly generated salt and
 // returns a slice of dst containing the encrypted packet and any error occurred.
-// Ensure len(dst) >= ciph.SaltSize() + len(plaintext) + aead.Overhead().
+// Ensure len(dst) >= ciph.SaltSize() + len(plaintext) + aead.Overhead(), plus 8
+// for the timestamp of ciphers with the timestamp extension.
 func Pack(dst, plaintext []byte, ciph Cipher) ([]byte, error) {
 	saltSize := ciph.SaltSize()
 	salt := dst[:saltSize]
@@ -30,8 +29,16 @@ func Pack(dst, plaintext []byte, ciph Cipher) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	internal.AddSalt(salt)
+	SaltFilterOf(ciph).add(salt)
 
+	if hasTimestamp(ciph) {
+		if len(dst) < saltSize+timestampSize+len(plaintext)+aead.Overhead() {
+			return nil, io.ErrShortBuffer
+		}
+		putTimestamp(dst[saltSize:])
+		n := copy(dst[saltSize+timestampSize:], plaintext)
+		plaintext = dst[saltSize : saltSize+timestampSize+n]
+	}
 	if len(dst) < saltSize+len(plaintext)+aead.Overhead() {
 		return nil, io.ErrShortBuffer
 	}
@@ -51,9 +58,6 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if internal.CheckSalt(salt) {
-		return nil, ErrRepeatedSalt
-	}
 	if len(pkt) < saltSize+aead.Overhead() {
 		return nil, ErrShortPacket
 	}
@@ -61,7 +65,14 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 		return nil, io.ErrShortBuffer
 	}
 	b, err := aead.Open(dst[:0], _zerononce[:aead.NonceSize()], pkt[saltSize:], nil)
-	return b, err
+	if err != nil {
+		return nil, err
+	}
+	// record only authentic salts, lest junk packets flush the filter
+	if SaltFilterOf(ciph).check(salt) {
+		return nil, ErrRepeatedSalt
+	}
+	return openTimestamp(ciph, b)
 }
 
 type packetConn struct {
@@ -84,7 +95,7 @@ func NewPacketConn(c net.PacketConn, ciph Cipher) net.PacketConn {
 func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	c.Lock()
 	defer c.Unlock()
-	buf, err := Pack(c.buf, b, c)
+	buf, err := Pack(c.buf, b, c.Cipher)
 	if err != nil {
 		return 0, err
 	}
@@ -98,7 +109,7 @@ func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	if err != nil {
 		return n, addr, err
 	}
-	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c)
+	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c.Cipher)
 	if err != nil {
 		return n, addr, err
 	}
@@ -117,7 +128,7 @@ type udpConn struct {
 func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	c.Lock()
 	defer c.Unlock()
-	buf, err := Pack(c.buf, b, c)
+	buf, err := Pack(c.buf, b, c.Cipher)
 	if err != nil {
 		return 0, err
 	}
@@ -131,7 +142,7 @@ func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	if err != nil {
 		return n, addr, err
 	}
-	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c)
+	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c.Cipher)
 	if err != nil {
 		return n, addr, err
 	}
@@ -143,7 +154,7 @@ func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
 func (c *udpConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
 	c.Lock()
 	defer c.Unlock()
-	buf, err := Pack(c.buf, b, c)
+	buf, err := Pack(c.buf, b, c.Cipher)
 	if err != nil {
 		return 0, err
 	}
@@ -157,7 +168,7 @@ func (c *udpConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
 	if err != nil {
 		return n, addr, err
 	}
-	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c)
+	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c.Cipher)
 	if err != nil {
 		return n, addr, err
 	}
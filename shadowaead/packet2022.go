@@ -0,0 +1,506 @@
+package shadowaead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrReplayedPacket means that a packet ID was seen before or is too old.
+var ErrReplayedPacket = errors.New("replayed packet")
+
+var errNoSession = errors.New("no session for address")
+
+// separateHeaderSize is the size of session ID and packet ID in a SIP022 UDP packet.
+const separateHeaderSize = 8 + 8
+
+// packetSessionTimeout is how long UDP servers keep idle sessions.
+const packetSessionTimeout = 5 * time.Minute
+
+// packetWindowSize is the number of recent packet IDs remembered per session.
+const packetWindowSize = 1024
+
+// slidingWindow rejects repeated packet IDs and those too old to tell.
+type slidingWindow struct {
+	last uint64
+	bits [packetWindowSize / 64]uint64
+}
+
+// Check reports whether id is new, and if so records it.
+func (w *slidingWindow) Check(id uint64) bool {
+	if id > w.last {
+		if d := id - w.last; d >= packetWindowSize {
+			w.bits = [packetWindowSize / 64]uint64{}
+		} else {
+			for i := w.last + 1; i <= id; i++ {
+				j := i % packetWindowSize
+				w.bits[j/64] &^= 1 << (j % 64)
+			}
+		}
+		w.last = id
+	} else if w.last-id >= packetWindowSize {
+		return false
+	}
+	j := id % packetWindowSize
+	if w.bits[j/64]&(1<<(j%64)) != 0 {
+		return false
+	}
+	w.bits[j/64] |= 1 << (j % 64)
+	return true
+}
+
+func newSessionID() uint64 {
+	var b [8]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err) // should never happen
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// sessionAEAD returns the AEAD sealing packet bodies of a session, or nil if
+// ciph seals whole packets under the pre-shared key.
+func sessionAEAD(ciph *blake3Cipher, sessionID uint64) (cipher.AEAD, error) {
+	if ciph.paead != nil {
+		return nil, nil
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], sessionID)
+	return ciph.Encrypter(b[:])
+}
+
+// bodyOffset returns the offset of the body in a plaintext packet laid out by
+// sealPacket2022 with eih identity headers.
+func bodyOffset(ciph *blake3Cipher, eih int) int {
+	if ciph.paead != nil {
+		return chacha20poly1305.NonceSizeX + separateHeaderSize
+	}
+	return separateHeaderSize + eih*aes.BlockSize
+}
+
+// sealPacket2022 encrypts in place a packet laid out in buf as the separate
+// header, any identity headers and n bytes of body at off, and returns the
+// encrypted packet. The separate header is encrypted by block, or the whole
+// packet is sealed by paead if not nil.
+func sealPacket2022(buf []byte, off, n int, block cipher.Block, paead, aead cipher.AEAD) ([]byte, error) {
+	if paead != nil {
+		nonce := buf[:chacha20poly1305.NonceSizeX]
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		if len(buf) < off+n+paead.Overhead() {
+			return nil, io.ErrShortBuffer
+		}
+		b := paead.Seal(buf[len(nonce):len(nonce)], nonce, buf[len(nonce):off+n], nil)
+		return buf[:len(nonce)+len(b)], nil
+	}
+
+	if len(buf) < off+n+aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+	var nonce [12]byte
+	hdr := buf[:separateHeaderSize]
+	copy(nonce[:], hdr[4:])
+	b := aead.Seal(buf[off:off], nonce[:aead.NonceSize()], buf[off:off+n], nil)
+	block.Encrypt(hdr, hdr)
+	return buf[:off+len(b)], nil
+}
+
+// openPacket2022 decrypts pkt in place and returns the session ID, the packet
+// ID and the body. On multi-user servers, the identity header following the
+// separate header is decrypted to the hash of the user PSK. aeadFor returns
+// the AEAD of the session of given ID and user PSK hash (if any).
+func openPacket2022(pkt []byte, ciph *blake3Cipher, aeadFor func(uint64, []byte) (cipher.AEAD, error)) (uint64, uint64, []byte, error) {
+	if paead := ciph.paead; paead != nil {
+		nonceSize := chacha20poly1305.NonceSizeX
+		if len(pkt) < nonceSize+separateHeaderSize+paead.Overhead() {
+			return 0, 0, nil, ErrShortPacket
+		}
+		b, err := paead.Open(pkt[nonceSize:nonceSize], pkt[:nonceSize], pkt[nonceSize:], nil)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		return binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:]), b[separateHeaderSize:], nil
+	}
+
+	var eih []byte
+	off := separateHeaderSize
+	if ciph.users != nil {
+		off += aes.BlockSize
+	}
+	if len(pkt) < off {
+		return 0, 0, nil, ErrShortPacket
+	}
+	hdr := pkt[:separateHeaderSize]
+	ciph.block.Decrypt(hdr, hdr)
+	if ciph.users != nil {
+		eih = pkt[separateHeaderSize:off]
+		ciph.block.Decrypt(eih, eih)
+		for i := range eih {
+			eih[i] ^= hdr[i]
+		}
+	}
+	sessionID, packetID := binary.BigEndian.Uint64(hdr), binary.BigEndian.Uint64(hdr[8:])
+	aead, err := aeadFor(sessionID, eih)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(pkt) < off+aead.Overhead() {
+		return 0, 0, nil, ErrShortPacket
+	}
+	b, err := aead.Open(pkt[off:off], hdr[4:4+aead.NonceSize()], pkt[off:], nil)
+	return sessionID, packetID, b, err
+}
+
+// splitPadding skips the padding length and padding at the beginning of b.
+func splitPadding(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, ErrBadHeader
+	}
+	padding := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+padding {
+		return nil, ErrBadHeader
+	}
+	return b[2+padding:], nil
+}
+
+type packetConn2022 struct {
+	net.PacketConn
+	ciph *blake3Cipher
+	sync.Mutex
+	buf []byte // write lock
+
+	sessionID uint64
+	packetID  uint64
+	aead      cipher.AEAD
+
+	// session of the server, only used by ReadFrom
+	hasRemote  bool
+	remoteID   uint64
+	remoteAEAD cipher.AEAD
+	window     slidingWindow
+}
+
+// NewPacketConn2022 wraps a net.PacketConn with a SIP022 cipher on the client
+// side. Each wrapped connection is a separate session.
+func NewPacketConn2022(c net.PacketConn, ciph Cipher2022) net.PacketConn {
+	const maxPacketSize = 64 * 1024
+	return &packetConn2022{PacketConn: c, ciph: ciph.blake3(), buf: make([]byte, maxPacketSize), sessionID: newSessionID()}
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn. b must
+// begin with the SOCKS address of the target.
+func (c *packetConn2022) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.aead == nil {
+		aead, err := sessionAEAD(c.ciph, c.sessionID)
+		if err != nil {
+			return 0, err
+		}
+		c.aead = aead
+	}
+
+	off := bodyOffset(c.ciph, len(c.ciph.identities))
+	if len(c.buf) < off+1+8+2+len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	hdr := c.buf[:separateHeaderSize]
+	if c.ciph.paead != nil {
+		hdr = c.buf[chacha20poly1305.NonceSizeX : chacha20poly1305.NonceSizeX+separateHeaderSize]
+	}
+	binary.BigEndian.PutUint64(hdr, c.sessionID)
+	binary.BigEndian.PutUint64(hdr[8:], c.packetID)
+	c.packetID++
+
+	// type, timestamp, padding length, target address and payload
+	body := c.buf[off:]
+	body[0] = headerTypeClient
+	binary.BigEndian.PutUint64(body[1:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(body[9:], 0)
+	n := 1 + 8 + 2 + copy(body[1+8+2:], b)
+
+	// identity headers, with the separate header encrypted by the first identity PSK
+	block := c.ciph.block
+	for i, id := range c.ciph.identities {
+		eih := c.buf[separateHeaderSize+i*aes.BlockSize : separateHeaderSize+(i+1)*aes.BlockSize]
+		for j := range eih {
+			eih[j] = id.next[j] ^ hdr[j]
+		}
+		id.block.Encrypt(eih, eih)
+		if i == 0 {
+			block = id.block
+		}
+	}
+
+	buf, err := sealPacket2022(c.buf, off, n, block, c.ciph.paead, c.aead)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(buf, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *packetConn2022) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	aead := c.remoteAEAD
+	sessionID, packetID, body, err := openPacket2022(b[:n], c.ciph, func(id uint64, _ []byte) (cipher.AEAD, error) {
+		if c.hasRemote && id == c.remoteID {
+			return aead, nil
+		}
+		var err error
+		aead, err = sessionAEAD(c.ciph, id)
+		return aead, err
+	})
+	if err != nil {
+		return n, addr, err
+	}
+
+	// type, timestamp, client session ID, padding length, padding, target address and payload
+	if len(body) < 1+8+8 || body[0] != headerTypeServer || binary.BigEndian.Uint64(body[9:]) != c.sessionID {
+		return n, addr, ErrBadHeader
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(body[1:])) {
+		return n, addr, ErrBadTimestamp
+	}
+	payload, err := splitPadding(body[1+8+8:])
+	if err != nil {
+		return n, addr, err
+	}
+
+	if !c.hasRemote || sessionID != c.remoteID {
+		c.hasRemote, c.remoteID, c.remoteAEAD, c.window = true, sessionID, aead, slidingWindow{}
+	}
+	if !c.window.Check(packetID) {
+		return n, addr, ErrReplayedPacket
+	}
+	return copy(b, payload), addr, nil
+}
+
+type session2022 struct {
+	user       *user2022
+	addr       netip.AddrPort // of the client, where replies go
+	clientID   uint64
+	clientAEAD cipher.AEAD
+	window     slidingWindow
+
+	ciph     *blake3Cipher // server or user cipher for responses
+	id       uint64
+	packetID uint64
+	aead     cipher.AEAD
+
+	lastSeen time.Time
+}
+
+type serverPacketConn2022 struct {
+	net.PacketConn
+	ciph *blake3Cipher
+	sync.Mutex
+	buf []byte // write lock
+
+	mu        sync.Mutex
+	sessions  map[sessionKey]*session2022
+	byAddr    map[netip.AddrPort]*session2022
+	lastPrune time.Time
+}
+
+// sessionKey identifies a client session, whose IDs are only unique to the
+// cipher of its user.
+type sessionKey struct {
+	ciph *blake3Cipher
+	id   uint64
+}
+
+// NewServerPacketConn2022 wraps a net.PacketConn with a SIP022 cipher on the
+// server side. Sessions are tracked by the session ID of the client, and
+// replies go to the address the latest packet of the session came from.
+// If ciph has users (see WithUsers), the returned connection has a User
+// method telling the user of the session at an address.
+func NewServerPacketConn2022(c net.PacketConn, ciph Cipher2022) net.PacketConn {
+	const maxPacketSize = 64 * 1024
+	return &serverPacketConn2022{
+		PacketConn: c,
+		ciph:       ciph.blake3(),
+		buf:        make([]byte, maxPacketSize),
+		sessions:   make(map[sessionKey]*session2022),
+		byAddr:     make(map[netip.AddrPort]*session2022),
+		lastPrune:  time.Now(),
+	}
+}
+
+func (c *serverPacketConn2022) session(addr netip.AddrPort) *session2022 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.byAddr[addr]
+}
+
+// User returns the name of the user of the session at addr on multi-user
+// servers, or an empty string.
+func (c *serverPacketConn2022) User(addr netip.AddrPort) string {
+	if s := c.session(addr); s != nil && s.user != nil {
+		return s.user.name
+	}
+	return ""
+}
+
+// WriteToUDPAddrPort encrypts b and write to addr using the embedded PacketConn.
+// b must begin with the SOCKS address of the source.
+func (c *serverPacketConn2022) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.mu.Lock()
+	s := c.byAddr[addr]
+	if s == nil {
+		c.mu.Unlock()
+		return 0, errNoSession
+	}
+	s.lastSeen = time.Now()
+	packetID := s.packetID
+	s.packetID++
+	c.mu.Unlock()
+
+	off := bodyOffset(s.ciph, 0)
+	if len(c.buf) < off+1+8+8+2+len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	hdr := c.buf[off-separateHeaderSize : off]
+	binary.BigEndian.PutUint64(hdr, s.id)
+	binary.BigEndian.PutUint64(hdr[8:], packetID)
+
+	// type, timestamp, client session ID, padding length, source address and payload
+	body := c.buf[off:]
+	body[0] = headerTypeServer
+	binary.BigEndian.PutUint64(body[1:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint64(body[9:], s.clientID)
+	binary.BigEndian.PutUint16(body[17:], 0)
+	n := 1 + 8 + 8 + 2 + copy(body[1+8+8+2:], b)
+
+	buf, err := sealPacket2022(c.buf, off, n, s.ciph.block, s.ciph.paead, s.aead)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(buf, net.UDPAddrFromAddrPort(addr))
+	return len(b), err
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *serverPacketConn2022) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errNoSession
+	}
+	return c.WriteToUDPAddrPort(b, ua.AddrPort())
+}
+
+// ReadFromUDPAddrPort reads from the embedded PacketConn and decrypts into b.
+func (c *serverPacketConn2022) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	n, na, err := c.PacketConn.ReadFrom(b)
+	var addr netip.AddrPort
+	if ua, ok := na.(*net.UDPAddr); ok {
+		addr = ua.AddrPort()
+	}
+	if err != nil {
+		return n, addr, err
+	}
+
+	var user *user2022
+	var clientAEAD cipher.AEAD
+	sessionID, packetID, body, err := openPacket2022(b[:n], c.ciph, func(id uint64, eih []byte) (cipher.AEAD, error) {
+		ciph := c.ciph
+		if eih != nil {
+			u, ok := c.ciph.users[[aes.BlockSize]byte(eih)]
+			if !ok {
+				return nil, ErrUnknownUser
+			}
+			user, ciph = &u, u.ciph
+		}
+		c.mu.Lock()
+		s := c.sessions[sessionKey{ciph, id}]
+		c.mu.Unlock()
+		if s != nil {
+			clientAEAD = s.clientAEAD
+			return clientAEAD, nil
+		}
+		var err error
+		clientAEAD, err = sessionAEAD(ciph, id)
+		return clientAEAD, err
+	})
+	if err != nil {
+		return n, addr, err
+	}
+
+	// type, timestamp, padding length, padding, target address and payload
+	if len(body) < 1+8 || body[0] != headerTypeClient {
+		return n, addr, ErrBadHeader
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(body[1:])) {
+		return n, addr, ErrBadTimestamp
+	}
+	payload, err := splitPadding(body[1+8:])
+	if err != nil {
+		return n, addr, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastPrune) > packetSessionTimeout {
+		for k, v := range c.sessions {
+			if now.Sub(v.lastSeen) > packetSessionTimeout {
+				delete(c.sessions, k)
+				if c.byAddr[v.addr] == v {
+					delete(c.byAddr, v.addr)
+				}
+			}
+		}
+		c.lastPrune = now
+	}
+	ciph := c.ciph
+	if user != nil {
+		ciph = user.ciph
+	}
+	key := sessionKey{ciph, sessionID}
+	s := c.sessions[key]
+	if s == nil {
+		id := newSessionID()
+		aead, err := sessionAEAD(ciph, id)
+		if err != nil {
+			return n, addr, err
+		}
+		s = &session2022{user: user, clientID: sessionID, clientAEAD: clientAEAD, ciph: ciph, id: id, aead: aead}
+		c.sessions[key] = s
+	}
+	if !s.window.Check(packetID) {
+		return n, addr, ErrReplayedPacket
+	}
+	// the client may have moved, as behind a NAT rebinding its port
+	if s.addr != addr {
+		if c.byAddr[s.addr] == s {
+			delete(c.byAddr, s.addr)
+		}
+		s.addr = addr
+	}
+	c.byAddr[addr] = s
+	s.lastSeen = now
+	return copy(b, payload), addr, nil
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *serverPacketConn2022) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDPAddrPort(b)
+	return n, net.UDPAddrFromAddrPort(addr), err
+}
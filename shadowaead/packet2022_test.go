@@ -0,0 +1,237 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// heldConn is a PacketConn keeping the packets written instead of sending
+// them while hold is set.
+type heldConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	hold bool
+	held [][]byte
+}
+
+func (c *heldConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hold {
+		c.held = append(c.held, append([]byte(nil), b...))
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+// packetPair returns a client and a server packet connection of p, and the
+// connection under the client.
+func packetPair(t *testing.T, p cipherPair) (client, server net.PacketConn, raw *heldConn) {
+	raw = &heldConn{PacketConn: listenUDP(t)}
+	return shadowaead.NewPacketConn2022(raw, p.client), shadowaead.NewServerPacketConn2022(listenUDP(t), p.server), raw
+}
+
+// exchange sends payload from client to server and back, checking that
+// each side reads what the other wrote.
+func exchange(t *testing.T, client, server net.PacketConn, payload []byte) {
+	target := socks.ParseAddr("192.0.2.1:53")
+	if _, err := client.WriteTo(append(target, payload...), server.LocalAddr()); err != nil {
+		t.Fatalf("Client write: %v", err)
+	}
+	b := make([]byte, 64*1024)
+	n, addr, err := server.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("Server read: %v", err)
+	}
+	if want := append(target, payload...); !bytes.Equal(b[:n], want) {
+		t.Fatalf("Server read %q, want %q", b[:n], want)
+	}
+	if _, err := server.WriteTo(append(target, payload...), addr); err != nil {
+		t.Fatalf("Server write: %v", err)
+	}
+	n, _, err = client.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("Client read: %v", err)
+	}
+	if want := append(target, payload...); !bytes.Equal(b[:n], want) {
+		t.Fatalf("Client read %q, want %q", b[:n], want)
+	}
+}
+
+func TestPacket2022RoundTrip(t *testing.T) {
+	for name, p := range ciphers2022(t) {
+		t.Run(name, func(t *testing.T) {
+			client, server, _ := packetPair(t, p)
+			exchange(t, client, server, []byte("ping"))
+			exchange(t, client, server, nil)
+			exchange(t, client, server, bytes.Repeat([]byte("ping"), 4096))
+		})
+	}
+}
+
+// deliver sends the packets held by raw to server and returns the errors
+// reading them.
+func deliver(t *testing.T, raw *heldConn, server net.PacketConn, pkts ...[]byte) []error {
+	var errs []error
+	b := make([]byte, 64*1024)
+	for _, pkt := range pkts {
+		if _, err := raw.PacketConn.WriteTo(pkt, server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := server.ReadFrom(b)
+		var ne net.Error
+		if errors.As(err, &ne) {
+			t.Fatal(err)
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func TestReplayedPacket2022(t *testing.T) {
+	for name, p := range ciphers2022(t) {
+		t.Run(name, func(t *testing.T) {
+			client, server, raw := packetPair(t, p)
+			raw.hold = true
+			for i := 0; i < 3; i++ {
+				client.WriteTo(socks.ParseAddr("192.0.2.1:53"), server.LocalAddr())
+			}
+			raw.hold = false
+			pkts := raw.held
+
+			// out of order within the window, then replayed
+			for i, err := range deliver(t, raw, server, pkts[2], pkts[0], pkts[1], pkts[0], pkts[2]) {
+				if want := i >= 3; errors.Is(err, shadowaead.ErrReplayedPacket) != want || (!want && err != nil) {
+					t.Fatalf("Packet %d read %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayedPacket2022OtherAddress(t *testing.T) {
+	p := ciphers2022(t)["2022-blake3-aes-256-gcm"]
+	client, server, raw := packetPair(t, p)
+	raw.hold = true
+	client.WriteTo(socks.ParseAddr("192.0.2.1:53"), server.LocalAddr())
+	raw.hold = false
+	pkt := raw.held[0]
+
+	if err := deliver(t, raw, server, pkt)[0]; err != nil {
+		t.Fatalf("Packet read: %v", err)
+	}
+	other := &heldConn{PacketConn: listenUDP(t)}
+	if err := deliver(t, other, server, pkt)[0]; !errors.Is(err, shadowaead.ErrReplayedPacket) {
+		t.Fatalf("Packet replayed from another address read: %v", err)
+	}
+
+	// the session still replies to the address it came from
+	exchange(t, client, server, []byte("ping"))
+}
+
+func TestPacket2022Window(t *testing.T) {
+	p := ciphers2022(t)["2022-blake3-aes-256-gcm"]
+	client, server, raw := packetPair(t, p)
+	raw.hold = true
+	client.WriteTo(socks.ParseAddr("192.0.2.1:53"), server.LocalAddr())
+	raw.hold = false
+	old := raw.held[0]
+
+	// packet IDs past the window of the one held
+	const window = 1024
+	for i := 0; i < window; i++ {
+		exchange(t, client, server, nil)
+	}
+	if err := deliver(t, raw, server, old)[0]; !errors.Is(err, shadowaead.ErrReplayedPacket) {
+		t.Fatalf("Packet older than the window read: %v", err)
+	}
+}
+
+// packet2022 returns a client packet of an AES method with key to target,
+// laid out by hand as SIP022 specifies, with timestamp ts.
+func packet2022(t *testing.T, ciph shadowaead.Cipher, key []byte, sessionID, packetID uint64, ts int64, target string) []byte {
+	hdr := binary.BigEndian.AppendUint64(nil, sessionID)
+	hdr = binary.BigEndian.AppendUint64(hdr, packetID)
+	aead, err := ciph.Encrypter(hdr[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte{0} // client packet
+	body = binary.BigEndian.AppendUint64(body, uint64(ts))
+	body = append(body, 0, 0) // no padding
+	body = append(body, socks.ParseAddr(target)...)
+
+	pkt := aead.Seal(append([]byte(nil), hdr...), hdr[4:], body, nil)
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk.Encrypt(pkt[:16], pkt[:16])
+	return pkt
+}
+
+func TestPacket2022Timestamp(t *testing.T) {
+	key := newKey(t, 32)
+	ciph, err := shadowaead.Blake3AESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := shadowaead.NewServerPacketConn2022(listenUDP(t), ciph)
+	raw := &heldConn{PacketConn: listenUDP(t)}
+	for i, tc := range []struct {
+		skew time.Duration
+		err  error
+	}{
+		{0, nil},
+		{20 * time.Second, nil},
+		{-20 * time.Second, nil},
+		{time.Minute, shadowaead.ErrBadTimestamp},
+		{-time.Minute, shadowaead.ErrBadTimestamp},
+	} {
+		pkt := packet2022(t, ciph, key, 1, uint64(i), time.Now().Add(tc.skew).Unix(), "192.0.2.1:53")
+		if err := deliver(t, raw, server, pkt)[0]; !errors.Is(err, tc.err) {
+			t.Fatalf("Packet %v off read %v, want %v", tc.skew, err, tc.err)
+		}
+	}
+}
+
+func TestPacket2022Identity(t *testing.T) {
+	ikey := newKey(t, 16)
+	users := map[string][]byte{"alice": newKey(t, 16), "bob": newKey(t, 16)}
+	for name := range users {
+		client, server, _ := packetPair(t, identityPair(t, ikey, users, name))
+		exchange(t, client, server, []byte("ping"))
+		addr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+		if u := server.(interface{ User(netip.AddrPort) string }).User(addr); u != name {
+			t.Fatalf("Packet of %s identified as %q", name, u)
+		}
+	}
+
+	client, server, raw := packetPair(t, identityPair(t, ikey, users, "mallory"))
+	raw.hold = true
+	client.WriteTo(socks.ParseAddr("192.0.2.1:53"), server.LocalAddr())
+	raw.hold = false
+	if err := deliver(t, raw, server, raw.held[0])[0]; !errors.Is(err, shadowaead.ErrUnknownUser) {
+		t.Fatalf("Packet of an unknown user read: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// captured returns a stream or packet of payload sent by a peer, as an
+// attacker recording it would see it.
+func captured(t *testing.T, ciph shadowaead.Cipher, payload []byte, stream bool) []byte {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stream {
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), payload, nil)
+	}
+	buf := bytes.NewBuffer(salt)
+	if _, err := shadowaead.NewWriter(buf, aead).Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newCipher(t *testing.T) shadowaead.Cipher {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	ciph, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciph
+}
+
+// readConn is a connection reading r.
+type readConn struct {
+	net.Conn // nil, only Read is used
+	r        io.Reader
+}
+
+func (c *readConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func TestReplayedStream(t *testing.T) {
+	ciph := newCipher(t)
+	stream := captured(t, ciph, []byte("shadowsocks"), true)
+
+	b := make([]byte, 64)
+	c := shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, ciph)
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "shadowsocks" {
+		t.Fatalf("First stream read %q, %v", b[:n], err)
+	}
+	c = shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, ciph)
+	if _, err := c.Read(b); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("Replayed stream read: %v", err)
+	}
+
+	// the same salt under another key is another stream
+	other := newCipher(t)
+	c = shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, other)
+	if _, err := c.Read(b); errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatal("Salt of another key taken as repeated")
+	}
+}
+
+func TestJunkStreamNotRecorded(t *testing.T) {
+	ciph := newCipher(t)
+	junk := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, junk); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 64)
+	c := shadowaead.NewConn(&readConn{r: bytes.NewReader(junk)}, ciph)
+	if _, err := c.Read(b); err == nil {
+		t.Fatal("Junk stream read")
+	}
+	if s := shadowaead.SaltFilterOf(ciph).Stats(); s.Entries != 0 {
+		t.Fatalf("Filter holds %d salts of junk streams, want 0", s.Entries)
+	}
+}
+
+func TestReplayedPacket(t *testing.T) {
+	ciph := newCipher(t)
+	pkt := captured(t, ciph, []byte("shadowsocks"), false)
+
+	b := make([]byte, 64)
+	if p, err := shadowaead.Unpack(b, pkt, ciph); err != nil || string(p) != "shadowsocks" {
+		t.Fatalf("First packet unpacked %q, %v", p, err)
+	}
+	if _, err := shadowaead.Unpack(b, pkt, ciph); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("Replayed packet unpacked: %v", err)
+	}
+}
+
+func TestReflectedPacket(t *testing.T) {
+	ciph := newCipher(t)
+	pkt, err := shadowaead.Pack(make([]byte, 64), []byte("shadowsocks"), ciph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shadowaead.Unpack(make([]byte, 64), pkt, ciph); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("Packet sent by this process unpacked: %v", err)
+	}
+}
+
+func TestSaltFilterPerCipher(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := shadowaead.Chacha20Poly1305(key)
+	b, _ := shadowaead.Chacha20Poly1305(key)
+	pkt := captured(t, a, []byte("shadowsocks"), false)
+
+	buf := make([]byte, 64)
+	if _, err := shadowaead.Unpack(buf, pkt, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shadowaead.Unpack(buf, pkt, b); err != nil {
+		t.Fatalf("Cipher with a filter of its own rejected a packet: %v", err)
+	}
+	if s := shadowaead.SaltFilterOf(a).Stats(); s.Entries != 1 {
+		t.Fatalf("Filter holds %d salts, want 1", s.Entries)
+	}
+
+	shared, err := shadowaead.WithSaltFilter(b, shadowaead.SaltFilterOf(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt = captured(t, a, []byte("shadowsocks"), false)
+	if _, err := shadowaead.Unpack(buf, pkt, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shadowaead.Unpack(buf, pkt, shared); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("Cipher sharing the filter unpacked a replayed packet: %v", err)
+	}
+
+	none, _ := shadowaead.WithSaltFilter(a, nil)
+	if _, err := shadowaead.Unpack(buf, pkt, none); err != nil {
+		t.Fatalf("Cipher without a filter rejected a packet: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package shadowaead
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal"
+)
+
+// ErrSaltFilterNotSupported means that a Cipher of another package has no
+// salt filter of its own.
+var ErrSaltFilterNotSupported = errors.New("salt filter not supported")
+
+// A SaltFilter remembers the salts of a key, sent and received, in a ring of
+// Bloom filters, to reject streams and packets repeating a received salt or
+// reflecting a sent one. Its memory is only allocated on first use. A nil
+// *SaltFilter remembers nothing.
+type SaltFilter struct {
+	capacity int
+	fpr      float64
+	slots    int
+	mu       sync.Mutex // held to allocate ring
+	ring     atomic.Pointer[internal.BloomRing]
+}
+
+// Salts are recorded per direction, so that the salts received never match
+// those sent by this process to a peer, as in tests or proxy chains of the
+// same key.
+const (
+	saltSent     = 's'
+	saltReceived = 'r'
+)
+
+// NewSaltFilter returns a SaltFilter remembering about capacity salts with
+// false positive rate fpr. It forgets the oldest capacity/slots of them at a
+// time once full. A capacity that is not positive returns nil.
+func NewSaltFilter(capacity int, fpr float64, slots int) (*SaltFilter, error) {
+	if capacity <= 0 {
+		return nil, nil
+	}
+	if !(fpr > 0 && fpr < 1) {
+		return nil, errors.New("false positive rate must be between 0 and 1")
+	}
+	if slots <= 0 || slots > capacity {
+		return nil, errors.New("slots must be positive and at most the capacity")
+	}
+	return &SaltFilter{capacity: capacity, fpr: fpr, slots: slots}, nil
+}
+
+// DefaultSaltFilter returns a SaltFilter sized by the SHADOWSOCKS_SF_CAPACITY,
+// SHADOWSOCKS_SF_FPR and SHADOWSOCKS_SF_SLOT environment variables, or by
+// default for a million salts with false positive rate 1e-6 in 10 slots. If
+// they are invalid, it takes the defaults; see SaltFilterSettings.
+func DefaultSaltFilter() *SaltFilter {
+	capacity, fpr, slots, _ := SaltFilterSettings()
+	f, _ := NewSaltFilter(capacity, fpr, slots)
+	return f
+}
+
+// defaultSaltFilterSettings are the settings of DefaultSaltFilter, read from
+// the environment once.
+var defaultSaltFilterSettings = sync.OnceValue(func() (s struct {
+	capacity, slots int
+	fpr             float64
+	err             error
+}) {
+	s.capacity, s.fpr, s.slots, s.err = internal.SaltFilterSettings()
+	if s.err == nil {
+		_, s.err = NewSaltFilter(s.capacity, s.fpr, s.slots)
+	}
+	if s.err != nil {
+		s.capacity, s.fpr, s.slots = internal.DefaultSFCapacity, internal.DefaultSFFPR, internal.DefaultSFSlot
+		s.err = fmt.Errorf("invalid SHADOWSOCKS_SF_* settings: %w", s.err)
+	}
+	return s
+})
+
+// SaltFilterSettings returns the capacity, false positive rate and slots of
+// DefaultSaltFilter, with an error if the SHADOWSOCKS_SF_* settings were
+// invalid and the defaults taken instead.
+func SaltFilterSettings() (capacity int, fpr float64, slots int, err error) {
+	s := defaultSaltFilterSettings()
+	return s.capacity, s.fpr, s.slots, s.err
+}
+
+// bloomRing returns the ring of f, allocating it on first use.
+func (f *SaltFilter) bloomRing() *internal.BloomRing {
+	if f == nil {
+		return nil
+	}
+	if r := f.ring.Load(); r != nil {
+		return r
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.ring.Load()
+	if r == nil {
+		r = internal.NewBloomRing(f.slots, f.capacity, f.fpr)
+		f.ring.Store(r)
+	}
+	return r
+}
+
+func saltEntry(dir byte, salt []byte) []byte {
+	return append([]byte{dir}, salt...)
+}
+
+// check reports whether salt, received from a peer, repeats a salt received
+// before or reflects one sent, and records it as received otherwise, in one
+// atomic step.
+func (f *SaltFilter) check(salt []byte) bool {
+	return f.bloomRing().Check(saltEntry(saltReceived, salt), saltEntry(saltSent, salt))
+}
+
+// add records salt as sent to a peer.
+func (f *SaltFilter) add(salt []byte) {
+	f.bloomRing().Add(saltEntry(saltSent, salt))
+}
+
+// SaltFilterStats are statistics of a SaltFilter.
+type SaltFilterStats struct {
+	Entries   int    // salts remembered
+	Capacity  int    // salts the filter is sized for
+	Rotations uint64 // times the oldest salts were forgotten for new ones
+}
+
+// Stats returns the statistics of f.
+func (f *SaltFilter) Stats() SaltFilterStats {
+	if f == nil {
+		return SaltFilterStats{}
+	}
+	r := f.ring.Load()
+	if r == nil {
+		return SaltFilterStats{Capacity: f.capacity}
+	}
+	return SaltFilterStats{Entries: r.Len(), Capacity: r.Cap(), Rotations: r.Rotations()}
+}
+
+// MarshalBinary returns a versioned and checksummed snapshot of f, or nil
+// if f was never used.
+func (f *SaltFilter) MarshalBinary() ([]byte, error) {
+	if f == nil {
+		return nil, nil
+	}
+	r := f.ring.Load()
+	if r == nil {
+		return nil, nil
+	}
+	return r.MarshalBinary()
+}
+
+// UnmarshalBinary restores f from a snapshot taken by MarshalBinary of a
+// SaltFilter of the same size. f is left as is on errors.
+func (f *SaltFilter) UnmarshalBinary(b []byte) error {
+	if f == nil {
+		return nil
+	}
+	return f.bloomRing().UnmarshalBinary(b)
+}
+
+// sharedSaltFilter is the salt filter of Ciphers of other packages.
+var sharedSaltFilter = sync.OnceValue(DefaultSaltFilter)
+
+// SaltFilterOf returns the salt filter of ciph, or nil if it has none, as
+// when disabled. Ciphers of this package start with a DefaultSaltFilter of
+// their own; those of other packages share one.
+func SaltFilterOf(ciph Cipher) *SaltFilter {
+	switch c := ciph.(type) {
+	case *timestampCipher:
+		return SaltFilterOf(c.Cipher)
+	case *metaCipher:
+		return c.filter
+	case Cipher2022:
+		return c.blake3().filter
+	}
+	return sharedSaltFilter()
+}
+
+// WithSaltFilter returns a copy of ciph that records its salts in f, which
+// may be shared with Ciphers of the same key, or in none if f is nil.
+func WithSaltFilter(ciph Cipher, f *SaltFilter) (Cipher, error) {
+	switch c := ciph.(type) {
+	case *timestampCipher:
+		inner, err := WithSaltFilter(c.Cipher, f)
+		if err != nil {
+			return nil, err
+		}
+		return &timestampCipher{inner}, nil
+	case *metaCipher:
+		a := *c
+		a.filter = f
+		return &a, nil
+	case Cipher2022:
+		a := *c.blake3()
+		a.filter = f
+		return &a, nil
+	}
+	return nil, ErrSaltFilterNotSupported
+}
@@ -4,10 +4,9 @@ import (
 	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"io"
 	"net"
-
-	"github.com/shadowsocks/go-shadowsocks2/internal"
 )
 
 // payloadSizeMask is the maximum size of payload in bytes.
@@ -16,19 +15,27 @@ const payloadSizeMask = 0x3FFF // 16*1024 - 1
 type writer struct {
 	io.Writer
 	cipher.AEAD
-	nonce []byte
-	buf   []byte
+	nonce      []byte
+	buf        []byte
+	maxPayload int
+	prefix     []byte // sent before the first payload, in the same record
 }
 
 // NewWriter wraps an io.Writer with AEAD encryption.
 func NewWriter(w io.Writer, aead cipher.AEAD) io.Writer { return newWriter(w, aead) }
 
 func newWriter(w io.Writer, aead cipher.AEAD) *writer {
+	return newWriterSize(w, aead, payloadSizeMask)
+}
+
+// newWriterSize returns a writer sealing records of at most maxPayload bytes.
+func newWriterSize(w io.Writer, aead cipher.AEAD, maxPayload int) *writer {
 	return &writer{
-		Writer: w,
-		AEAD:   aead,
-		buf:    make([]byte, 2+aead.Overhead()+payloadSizeMask+aead.Overhead()),
-		nonce:  make([]byte, aead.NonceSize()),
+		Writer:     w,
+		AEAD:       aead,
+		buf:        make([]byte, 2+aead.Overhead()+maxPayload+aead.Overhead()),
+		nonce:      make([]byte, aead.NonceSize()),
+		maxPayload: maxPayload,
 	}
 }
 
@@ -44,11 +51,14 @@ func (w *writer) Write(b []byte) (int, error) {
 func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
 	for {
 		buf := w.buf
-		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
-		nr, er := r.Read(payloadBuf)
+		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+w.maxPayload]
+		np := copy(payloadBuf, w.prefix)
+		w.prefix = nil
+		nr, er := r.Read(payloadBuf[np:])
+		n += int64(nr)
+		nr += np
 
 		if nr > 0 {
-			n += int64(nr)
 			buf = buf[:2+w.Overhead()+nr+w.Overhead()]
 			payloadBuf = payloadBuf[:nr]
 			buf[0], buf[1] = byte(nr>>8), byte(nr) // big-endian payload size
@@ -79,53 +89,68 @@ func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
 type reader struct {
 	io.Reader
 	cipher.AEAD
-	nonce    []byte
-	buf      []byte
-	leftover []byte
+	nonce      []byte
+	buf        []byte
+	leftover   []byte
+	maxPayload int
 }
 
 // NewReader wraps an io.Reader with AEAD decryption.
 func NewReader(r io.Reader, aead cipher.AEAD) io.Reader { return newReader(r, aead) }
 
 func newReader(r io.Reader, aead cipher.AEAD) *reader {
+	return newReaderSize(r, aead, payloadSizeMask)
+}
+
+// newReaderSize returns a reader opening records of at most maxPayload bytes.
+func newReaderSize(r io.Reader, aead cipher.AEAD, maxPayload int) *reader {
 	return &reader{
-		Reader: r,
-		AEAD:   aead,
-		buf:    make([]byte, payloadSizeMask+aead.Overhead()),
-		nonce:  make([]byte, aead.NonceSize()),
+		Reader:     r,
+		AEAD:       aead,
+		buf:        make([]byte, maxPayload+aead.Overhead()),
+		nonce:      make([]byte, aead.NonceSize()),
+		maxPayload: maxPayload,
 	}
 }
 
-// read and decrypt a record into the internal buffer. Return decrypted payload length and any error encountered.
-func (r *reader) read() (int, error) {
-	// decrypt payload size
-	buf := r.buf[:2+r.Overhead()]
+// read and decrypt a chunk of size plaintext bytes into the internal buffer.
+func (r *reader) readChunk(size int) ([]byte, error) {
+	buf := r.buf[:size+r.Overhead()]
 	_, err := io.ReadFull(r.Reader, buf)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	_, err = r.Open(buf[:0], r.nonce, buf, nil)
 	increment(r.nonce)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return buf[:size], nil
+}
 
-	size := (int(buf[0])<<8 + int(buf[1])) & payloadSizeMask
-
-	// decrypt payload
-	buf = r.buf[:size+r.Overhead()]
-	_, err = io.ReadFull(r.Reader, buf)
+// read and decrypt the payload size of a record.
+func (r *reader) readSize() (int, error) {
+	buf, err := r.readChunk(2)
 	if err != nil {
 		return 0, err
 	}
+	return (int(buf[0])<<8 + int(buf[1])) & r.maxPayload, nil
+}
 
-	_, err = r.Open(buf[:0], r.nonce, buf, nil)
-	increment(r.nonce)
+// read and decrypt a record into the internal buffer. Return decrypted payload length and any error encountered.
+func (r *reader) read() (int, error) {
+	// decrypt payload size
+	size, err := r.readSize()
 	if err != nil {
 		return 0, err
 	}
 
+	// decrypt payload
+	if _, err = r.readChunk(size); err != nil {
+		return 0, err
+	}
+
 	return size, nil
 }
 
@@ -196,11 +221,16 @@ func increment(b []byte) {
 type streamConn struct {
 	net.Conn
 	Cipher
-	r *reader
-	w *writer
+	r     *reader
+	w     *writer
+	users *UserSet // users of a multi-user server
+	user  string   // identified by the request on multi-user servers
 }
 
 func (c *streamConn) initReader() error {
+	if c.users != nil {
+		return c.initUserReader()
+	}
 	salt := make([]byte, c.SaltSize())
 	if _, err := io.ReadFull(c.Conn, salt); err != nil {
 		return err
@@ -210,11 +240,38 @@ func (c *streamConn) initReader() error {
 		return err
 	}
 
-	if internal.CheckSalt(salt) {
+	r := newReader(c.Conn, aead)
+	size, err := r.readSize()
+	if err != nil {
+		return err
+	}
+
+	// record only authentic salts, lest junk streams flush the filter
+	if SaltFilterOf(c.Cipher).check(salt) {
 		return ErrRepeatedSalt
 	}
 
-	c.r = newReader(c.Conn, aead)
+	if _, err := r.readChunk(size); err != nil {
+		return err
+	}
+	r.leftover = r.buf[:size]
+	c.r = r
+	return c.readTimestamp()
+}
+
+// readTimestamp reads and checks the timestamp starting the payload of
+// streams of ciphers with the timestamp extension.
+func (c *streamConn) readTimestamp() error {
+	if !hasTimestamp(c.Cipher) {
+		return nil
+	}
+	var ts [timestampSize]byte
+	if _, err := io.ReadFull(c.r, ts[:]); err != nil {
+		return err
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(ts[:])) {
+		return ErrBadTimestamp
+	}
 	return nil
 }
 
@@ -237,6 +294,9 @@ func (c *streamConn) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (c *streamConn) initWriter() error {
+	if c.Cipher == nil { // multi-user servers respond once the user is known
+		return errNoRequest
+	}
 	salt := make([]byte, c.SaltSize())
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return err
@@ -249,8 +309,12 @@ func (c *streamConn) initWriter() error {
 	if err != nil {
 		return err
 	}
-	internal.AddSalt(salt)
+	SaltFilterOf(c.Cipher).add(salt)
 	c.w = newWriter(c.Conn, aead)
+	if hasTimestamp(c.Cipher) {
+		c.w.prefix = make([]byte, timestampSize)
+		putTimestamp(c.w.prefix)
+	}
 	return nil
 }
 
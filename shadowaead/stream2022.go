@@ -0,0 +1,384 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// payloadSizeMask2022 is the maximum size of payload in bytes for SIP022 streams.
+const payloadSizeMask2022 = 0xFFFF
+
+// Header types of SIP022 requests and responses.
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+)
+
+// maxPaddingLength is the maximum length of padding in SIP022 request headers.
+const maxPaddingLength = 900
+
+// maxTimeDiff is the maximum difference in seconds allowed between the
+// timestamp in a SIP022 header and the local clock.
+const maxTimeDiff = 30
+
+// ErrBadTimestamp means that the timestamp of a header is out of the allowed window.
+var ErrBadTimestamp = errors.New("bad timestamp")
+
+// ErrBadHeader means that a header is malformed or of the wrong type.
+var ErrBadHeader = errors.New("bad header")
+
+var errNoRequest = errors.New("no request to respond to")
+
+func validTimestamp(ts uint64) bool {
+	d := time.Now().Unix() - int64(ts)
+	return -maxTimeDiff <= d && d <= maxTimeDiff
+}
+
+type streamConn2022 struct {
+	net.Conn
+	ciph   *blake3Cipher
+	server bool
+	user   *user2022 // identified by the request on multi-user servers
+	salt   []byte    // salt of the request stream
+	r      *reader
+	w      *writer
+}
+
+// User returns the name of the user identified by the request on multi-user
+// servers, or an empty string.
+func (c *streamConn2022) User() string {
+	if c.user == nil {
+		return ""
+	}
+	return c.user.name
+}
+
+// readIdentity reads the identity header of a request with salt on
+// multi-user servers and returns the cipher of the user.
+func (c *streamConn2022) readIdentity(salt []byte) (*blake3Cipher, error) {
+	var eih [aes.BlockSize]byte
+	if _, err := io.ReadFull(c.Conn, eih[:]); err != nil {
+		return nil, err
+	}
+	blk, err := aes.NewCipher(blake3Subkey(c.ciph.psk, salt, "shadowsocks 2022 identity subkey"))
+	if err != nil {
+		return nil, err
+	}
+	blk.Decrypt(eih[:], eih[:])
+	u, ok := c.ciph.users[eih]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	c.user = &u
+	return u.ciph, nil
+}
+
+// readRequest reads the request header on the server side. The target
+// address and the initial payload are left over for the following reads.
+func (c *streamConn2022) readRequest() error {
+	salt := make([]byte, c.ciph.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	ciph := c.ciph
+	if ciph.users != nil {
+		var err error
+		if ciph, err = c.readIdentity(salt); err != nil {
+			return err
+		}
+	}
+	aead, err := ciph.Decrypter(salt)
+	if err != nil {
+		return err
+	}
+
+	r := newReaderSize(c.Conn, aead, payloadSizeMask2022)
+
+	// fixed-length header: type, timestamp, length of variable-length header
+	buf, err := r.readChunk(1 + 8 + 2)
+	if err != nil {
+		return err
+	}
+	// record only authentic salts, lest junk streams flush the filter
+	if ciph.filter.check(salt) {
+		return ErrRepeatedSalt
+	}
+	if buf[0] != headerTypeClient {
+		return ErrBadHeader
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(buf[1:])) {
+		return ErrBadTimestamp
+	}
+	size := int(binary.BigEndian.Uint16(buf[9:]))
+
+	// variable-length header: target address, padding length, padding, initial payload
+	buf, err = r.readChunk(size)
+	if err != nil {
+		return err
+	}
+	addr := socks.SplitAddr(buf)
+	if addr == nil || len(buf) < len(addr)+2 {
+		return ErrBadHeader
+	}
+	padding := int(binary.BigEndian.Uint16(buf[len(addr):]))
+	if padding > maxPaddingLength || len(buf) < len(addr)+2+padding {
+		return ErrBadHeader
+	}
+	n := copy(buf[len(addr):], buf[len(addr)+2+padding:])
+
+	c.salt = salt
+	c.r = r
+	c.r.leftover = buf[:len(addr)+n]
+	return nil
+}
+
+// readResponse reads the response header on the client side.
+func (c *streamConn2022) readResponse() error {
+	salt := make([]byte, c.ciph.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.ciph.Decrypter(salt)
+	if err != nil {
+		return err
+	}
+
+	r := newReaderSize(c.Conn, aead, payloadSizeMask2022)
+
+	// fixed-length header: type, timestamp, request salt, length of first payload chunk
+	buf, err := r.readChunk(1 + 8 + len(salt) + 2)
+	if err != nil {
+		return err
+	}
+	if c.ciph.filter.check(salt) {
+		return ErrRepeatedSalt
+	}
+	if buf[0] != headerTypeServer || !bytes.Equal(buf[9:9+len(salt)], c.salt) {
+		return ErrBadHeader
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(buf[1:])) {
+		return ErrBadTimestamp
+	}
+	size := int(binary.BigEndian.Uint16(buf[9+len(salt):]))
+
+	buf, err = r.readChunk(size)
+	if err != nil {
+		return err
+	}
+
+	c.r = r
+	c.r.leftover = buf
+	return nil
+}
+
+func (c *streamConn2022) initReader() error {
+	if c.server {
+		return c.readRequest()
+	}
+	return c.readResponse()
+}
+
+func (c *streamConn2022) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *streamConn2022) WriteTo(w io.Writer) (int64, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.WriteTo(w)
+}
+
+// writeRequest writes the request header on the client side. b must begin
+// with the target address; the rest of b is sent as initial payload.
+func (c *streamConn2022) writeRequest(b []byte) (int, error) {
+	addr := socks.SplitAddr(b)
+	if addr == nil {
+		return 0, ErrBadHeader
+	}
+	payload := b[len(addr):]
+
+	salt := make([]byte, c.ciph.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.ciph.Encrypter(salt)
+	if err != nil {
+		return 0, err
+	}
+	w := newWriterSize(c.Conn, aead, payloadSizeMask2022)
+
+	// pad requests without initial payload to hide the length of the address
+	padding := 0
+	if len(payload) == 0 {
+		padding = 1 + mrand.Intn(maxPaddingLength)
+	}
+	n := len(payload)
+	if limit := payloadSizeMask2022 - len(addr) - 2 - padding; n > limit {
+		n = limit
+	}
+	size := len(addr) + 2 + padding + n
+	eih := len(c.ciph.identities) * aes.BlockSize
+
+	buf := make([]byte, len(salt)+eih+1+8+2+aead.Overhead()+size+aead.Overhead())
+	copy(buf, salt)
+
+	// identity headers
+	for i, id := range c.ciph.identities {
+		blk, err := aes.NewCipher(blake3Subkey(id.psk, salt, "shadowsocks 2022 identity subkey"))
+		if err != nil {
+			return 0, err
+		}
+		blk.Encrypt(buf[len(salt)+i*aes.BlockSize:], id.next[:])
+	}
+
+	hdr := buf[len(salt)+eih : len(salt)+eih+1+8+2]
+	hdr[0] = headerTypeClient
+	binary.BigEndian.PutUint64(hdr[1:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(hdr[9:], uint16(size))
+	w.Seal(hdr[:0], w.nonce, hdr, nil)
+	increment(w.nonce)
+
+	vhdr := buf[len(salt)+eih+len(hdr)+aead.Overhead() : len(buf)-aead.Overhead()]
+	copy(vhdr, addr)
+	binary.BigEndian.PutUint16(vhdr[len(addr):], uint16(padding))
+	copy(vhdr[len(addr)+2+padding:], payload[:n])
+	w.Seal(vhdr[:0], w.nonce, vhdr, nil)
+	increment(w.nonce)
+
+	// set before writing, as the response echoing salt may be read at once
+	c.ciph.filter.add(salt)
+	c.salt = salt
+	c.w = w
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+
+	if n < len(payload) {
+		if _, err := w.Write(payload[n:]); err != nil {
+			return len(addr) + n, err
+		}
+	}
+	return len(b), nil
+}
+
+// writeResponse writes the response header on the server side, with b as
+// the first payload chunk.
+func (c *streamConn2022) writeResponse(b []byte) (int, error) {
+	if c.salt == nil {
+		return 0, errNoRequest
+	}
+	ciph := c.ciph
+	if c.user != nil {
+		ciph = c.user.ciph
+	}
+
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		return 0, err
+	}
+	w := newWriterSize(c.Conn, aead, payloadSizeMask2022)
+
+	n := len(b)
+	if n > payloadSizeMask2022 {
+		n = payloadSizeMask2022
+	}
+
+	buf := make([]byte, len(salt)+1+8+len(c.salt)+2+aead.Overhead()+n+aead.Overhead())
+	copy(buf, salt)
+
+	hdr := buf[len(salt) : len(salt)+1+8+len(c.salt)+2]
+	hdr[0] = headerTypeServer
+	binary.BigEndian.PutUint64(hdr[1:], uint64(time.Now().Unix()))
+	copy(hdr[9:], c.salt)
+	binary.BigEndian.PutUint16(hdr[9+len(c.salt):], uint16(n))
+	w.Seal(hdr[:0], w.nonce, hdr, nil)
+	increment(w.nonce)
+
+	payload := buf[len(salt)+len(hdr)+aead.Overhead() : len(buf)-aead.Overhead()]
+	copy(payload, b[:n])
+	w.Seal(payload[:0], w.nonce, payload, nil)
+	increment(w.nonce)
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	ciph.filter.add(salt)
+	c.w = w
+
+	if n < len(b) {
+		if _, err := w.Write(b[n:]); err != nil {
+			return n, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *streamConn2022) Write(b []byte) (int, error) {
+	if c.w == nil {
+		if c.server {
+			return c.writeResponse(b)
+		}
+		return c.writeRequest(b)
+	}
+	return c.w.Write(b)
+}
+
+func (c *streamConn2022) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if c.w == nil {
+		// the first chunk goes with the header
+		buf := make([]byte, payloadSizeMask2022)
+		for c.w == nil {
+			nr, er := r.Read(buf)
+			if nr > 0 {
+				if _, ew := c.Write(buf[:nr]); ew != nil {
+					return n, ew
+				}
+				n += int64(nr)
+			}
+			if er != nil {
+				if er != io.EOF { // ignore EOF as per io.ReaderFrom contract
+					return n, er
+				}
+				return n, nil
+			}
+		}
+	}
+	nr, err := c.w.ReadFrom(r)
+	return n + nr, err
+}
+
+// NewConn2022 wraps a stream-oriented net.Conn with a SIP022 cipher on the
+// client side. The first write must begin with the SOCKS address of the target.
+func NewConn2022(c net.Conn, ciph Cipher2022) net.Conn {
+	return &streamConn2022{Conn: c, ciph: ciph.blake3()}
+}
+
+// NewServerConn2022 wraps a stream-oriented net.Conn with a SIP022 cipher on
+// the server side. Reads return the SOCKS address of the target followed by
+// the payload, as with NewConn. If ciph has users (see WithUsers), the
+// returned connection has a User method telling who sent the request.
+func NewServerConn2022(c net.Conn, ciph Cipher2022) net.Conn {
+	return &streamConn2022{Conn: c, ciph: ciph.blake3(), server: true}
+}
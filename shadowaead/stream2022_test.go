@@ -0,0 +1,259 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func newKey(t *testing.T, size int) []byte {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// cipherPair is a client and a server cipher of the same key, each with a
+// salt filter of its own, so that the server takes no request for one
+// reflected.
+type cipherPair struct {
+	client, server shadowaead.Cipher2022
+}
+
+// ciphers2022 returns a cipher pair of each SIP022 method.
+func ciphers2022(t *testing.T) map[string]cipherPair {
+	m := make(map[string]cipherPair)
+	for name, c := range map[string]struct {
+		size int
+		new  func([]byte) (shadowaead.Cipher2022, error)
+	}{
+		"2022-blake3-aes-128-gcm":       {16, shadowaead.Blake3AESGCM},
+		"2022-blake3-aes-256-gcm":       {32, shadowaead.Blake3AESGCM},
+		"2022-blake3-chacha20-poly1305": {32, shadowaead.Blake3Chacha20Poly1305},
+	} {
+		key := newKey(t, c.size)
+		client, err := c.new(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := c.new(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[name] = cipherPair{client, server}
+	}
+	return m
+}
+
+// roundTrip2022 sends request to target through a client connection with
+// cciph to a server connection with sciph, and response back. The client
+// reads in a goroutine of its own, as relays do. It returns the server
+// connection once done.
+func roundTrip2022(t *testing.T, cciph, sciph shadowaead.Cipher2022, target string, request, response []byte) net.Conn {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+	client := shadowaead.NewConn2022(a, cciph)
+	server := shadowaead.NewServerConn2022(b, sciph)
+
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(response))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Errorf("Client read: %v", err)
+		}
+		read <- buf
+	}()
+	go func() {
+		if _, err := client.Write(append(socks.ParseAddr(target), request...)); err != nil {
+			t.Errorf("Client write: %v", err)
+		}
+	}()
+
+	addr, err := socks.ReadAddr(server)
+	if err != nil {
+		t.Fatalf("Server read address: %v", err)
+	}
+	if addr.String() != target {
+		t.Fatalf("Server read address %v, want %v", addr, target)
+	}
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Server read: %v", err)
+	}
+	if !bytes.Equal(buf, request) {
+		t.Fatalf("Server read %q, want %q", buf, request)
+	}
+	if _, err := server.Write(response); err != nil {
+		t.Fatalf("Server write: %v", err)
+	}
+	if buf := <-read; !bytes.Equal(buf, response) {
+		t.Fatalf("Client read %q, want %q", buf, response)
+	}
+	return server
+}
+
+func TestStream2022RoundTrip(t *testing.T) {
+	for name, p := range ciphers2022(t) {
+		t.Run(name, func(t *testing.T) {
+			roundTrip2022(t, p.client, p.server, "example.com:443", []byte("ping"), []byte("pong"))
+			// without initial payload, and over a chunk long
+			roundTrip2022(t, p.client, p.server, "192.0.2.1:80", nil, bytes.Repeat([]byte("pong"), 0x10000))
+		})
+	}
+}
+
+// request2022 returns a request stream to target with payload, laid out by
+// hand as SIP022 specifies, with timestamp ts.
+func request2022(t *testing.T, ciph shadowaead.Cipher, ts int64, target string, payload []byte) []byte {
+	salt := newKey(t, ciph.SaltSize())
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+
+	addr := socks.ParseAddr(target)
+	vhdr := append(append(addr, 0, 0), payload...) // no padding
+	hdr := []byte{0}                               // client stream
+	hdr = binary.BigEndian.AppendUint64(hdr, uint64(ts))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(vhdr)))
+
+	stream := aead.Seal(salt, nonce, hdr, nil)
+	nonce[0]++
+	return aead.Seal(stream, nonce, vhdr, nil)
+}
+
+func TestStream2022Request(t *testing.T) {
+	for name, p := range ciphers2022(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range []struct {
+				skew time.Duration
+				err  error
+			}{
+				{0, nil},
+				{20 * time.Second, nil},
+				{-20 * time.Second, nil},
+				{time.Minute, shadowaead.ErrBadTimestamp},
+				{-time.Minute, shadowaead.ErrBadTimestamp},
+			} {
+				req := request2022(t, p.client, time.Now().Add(tc.skew).Unix(), "example.com:80", []byte("ping"))
+				c := shadowaead.NewServerConn2022(&readConn{r: bytes.NewReader(req)}, p.server)
+				b := make([]byte, 64)
+				n, err := c.Read(b)
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("Request %v off read %v, want %v", tc.skew, err, tc.err)
+				}
+				if want := append(socks.ParseAddr("example.com:80"), "ping"...); err == nil && !bytes.Equal(b[:n], want) {
+					t.Fatalf("Request read %q, want %q", b[:n], want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayedStream2022(t *testing.T) {
+	for name, p := range ciphers2022(t) {
+		t.Run(name, func(t *testing.T) {
+			req := request2022(t, p.client, time.Now().Unix(), "example.com:80", []byte("ping"))
+			b := make([]byte, 64)
+			c := shadowaead.NewServerConn2022(&readConn{r: bytes.NewReader(req)}, p.server)
+			if _, err := c.Read(b); err != nil {
+				t.Fatalf("First stream read: %v", err)
+			}
+			c = shadowaead.NewServerConn2022(&readConn{r: bytes.NewReader(req)}, p.server)
+			if _, err := c.Read(b); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+				t.Fatalf("Replayed stream read: %v", err)
+			}
+
+			junk := newKey(t, 128)
+			c = shadowaead.NewServerConn2022(&readConn{r: bytes.NewReader(junk)}, p.server)
+			if _, err := c.Read(b); err == nil {
+				t.Fatal("Junk stream read")
+			}
+			if s := shadowaead.SaltFilterOf(p.server).Stats(); s.Entries != 1 {
+				t.Fatalf("Filter holds %d salts, want 1", s.Entries)
+			}
+		})
+	}
+}
+
+// identityPair returns a cipher pair of a multi-user server with identity
+// key ikey, and a client of user.
+func identityPair(t *testing.T, ikey []byte, users map[string][]byte, user string) cipherPair {
+	var list []shadowaead.User
+	for name, key := range users {
+		ciph, err := shadowaead.Blake3AESGCM(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, shadowaead.User{Name: name, Cipher: ciph})
+	}
+	iciph, err := shadowaead.Blake3AESGCM(ikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := shadowaead.WithUsers(iciph, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, ok := users[user]
+	if !ok {
+		key = newKey(t, len(ikey))
+	}
+	uciph, err := shadowaead.Blake3AESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := shadowaead.WithIdentities(uciph, ikey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cipherPair{client, server}
+}
+
+func TestStream2022Identity(t *testing.T) {
+	ikey := newKey(t, 32)
+	users := map[string][]byte{"alice": newKey(t, 32), "bob": newKey(t, 32)}
+	for name := range users {
+		p := identityPair(t, ikey, users, name)
+		c := roundTrip2022(t, p.client, p.server, "example.com:443", []byte("ping"), []byte("pong"))
+		if u := c.(interface{ User() string }).User(); u != name {
+			t.Fatalf("Request of %s identified as %q", name, u)
+		}
+	}
+
+	p := identityPair(t, ikey, users, "mallory")
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go shadowaead.NewConn2022(a, p.client).Write(socks.ParseAddr("example.com:443"))
+	if _, err := shadowaead.NewServerConn2022(b, p.server).Read(make([]byte, 64)); !errors.Is(err, shadowaead.ErrUnknownUser) {
+		t.Fatalf("Request of an unknown user read: %v", err)
+	}
+}
+
+func TestIdentityNotSupported(t *testing.T) {
+	ciph, err := shadowaead.Blake3Chacha20Poly1305(newKey(t, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shadowaead.WithIdentities(ciph, newKey(t, 32)); !errors.Is(err, shadowaead.ErrIdentityNotSupported) {
+		t.Fatalf("WithIdentities: %v", err)
+	}
+	if _, err := shadowaead.WithUsers(ciph, nil); !errors.Is(err, shadowaead.ErrIdentityNotSupported) {
+		t.Fatalf("WithUsers: %v", err)
+	}
+}
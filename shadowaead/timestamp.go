@@ -0,0 +1,44 @@
+package shadowaead
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// timestampSize is the size of the timestamp starting payloads of ciphers
+// with the timestamp extension.
+const timestampSize = 8
+
+type timestampCipher struct{ Cipher }
+
+// WithTimestamp returns ciph with the timestamp extension: the payload of
+// every stream and packet starts with the big-endian Unix time of sending
+// in 8 bytes, and those off the local clock by more than 30 seconds are
+// rejected with ErrBadTimestamp. Along with the salt filter, this keeps
+// captured streams and packets from being replayed even once the filter
+// has forgotten their salts, as after a restart. Both ends must use it.
+func WithTimestamp(ciph Cipher) Cipher { return &timestampCipher{ciph} }
+
+func hasTimestamp(ciph Cipher) bool {
+	_, ok := ciph.(*timestampCipher)
+	return ok
+}
+
+func putTimestamp(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+}
+
+// openTimestamp checks the timestamp starting the payload b of a packet of
+// ciph, if it has the extension, and returns the rest.
+func openTimestamp(ciph Cipher, b []byte) ([]byte, error) {
+	if !hasTimestamp(ciph) {
+		return b, nil
+	}
+	if len(b) < timestampSize {
+		return nil, ErrShortPacket
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(b)) {
+		return nil, ErrBadTimestamp
+	}
+	return b[timestampSize:], nil
+}
@@ -0,0 +1,116 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// stamped returns payload after the timestamp ts, as a peer with the
+// timestamp extension sends it.
+func stamped(ts int64, payload string) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(ts)), payload...)
+}
+
+var skews = []struct {
+	skew time.Duration
+	err  error
+}{
+	{0, nil},
+	{20 * time.Second, nil},
+	{-20 * time.Second, nil},
+	{time.Minute, shadowaead.ErrBadTimestamp},
+	{-time.Minute, shadowaead.ErrBadTimestamp},
+}
+
+func TestTimestampStream(t *testing.T) {
+	ciph := newCipher(t)
+	server := shadowaead.WithTimestamp(ciph)
+	b := make([]byte, 64)
+	for _, tc := range skews {
+		stream := captured(t, ciph, stamped(time.Now().Add(tc.skew).Unix(), "shadowsocks"), true)
+		n, err := shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, server).Read(b)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Stream %v off read %v, want %v", tc.skew, err, tc.err)
+		}
+		if err == nil && string(b[:n]) != "shadowsocks" {
+			t.Fatalf("Stream read %q, want %q", b[:n], "shadowsocks")
+		}
+	}
+
+	stream := captured(t, ciph, stamped(time.Now().Unix(), "shadowsocks"), true)
+	if _, err := shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, server).Read(b); err != nil {
+		t.Fatalf("First stream read: %v", err)
+	}
+	if _, err := shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, server).Read(b); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("Replayed stream read: %v", err)
+	}
+
+	// a peer without the extension sends the payload right away
+	stream = captured(t, ciph, []byte("shadowsocks"), true)
+	if _, err := shadowaead.NewConn(&readConn{r: bytes.NewReader(stream)}, server).Read(b); !errors.Is(err, shadowaead.ErrBadTimestamp) {
+		t.Fatalf("Stream without timestamp read: %v", err)
+	}
+}
+
+func TestTimestampPacket(t *testing.T) {
+	ciph := newCipher(t)
+	server := shadowaead.WithTimestamp(ciph)
+	b := make([]byte, 64)
+	for _, tc := range skews {
+		pkt := captured(t, ciph, stamped(time.Now().Add(tc.skew).Unix(), "shadowsocks"), false)
+		p, err := shadowaead.Unpack(b, pkt, server)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Packet %v off unpacked %v, want %v", tc.skew, err, tc.err)
+		}
+		if err == nil && string(p) != "shadowsocks" {
+			t.Fatalf("Packet unpacked %q, want %q", p, "shadowsocks")
+		}
+	}
+
+	pkt := captured(t, ciph, stamped(time.Now().Unix(), "shadowsocks"), false)
+	if _, err := shadowaead.Unpack(b, pkt, server); err != nil {
+		t.Fatalf("First packet unpacked: %v", err)
+	}
+	if _, err := shadowaead.Unpack(b, pkt, server); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("Replayed packet unpacked: %v", err)
+	}
+
+	pkt = captured(t, ciph, []byte("shadowsocks"), false)
+	if _, err := shadowaead.Unpack(b, pkt, server); !errors.Is(err, shadowaead.ErrBadTimestamp) {
+		t.Fatalf("Packet without timestamp unpacked: %v", err)
+	}
+	pkt = captured(t, ciph, []byte("ping"), false)
+	if _, err := shadowaead.Unpack(b, pkt, server); !errors.Is(err, shadowaead.ErrShortPacket) {
+		t.Fatalf("Packet shorter than a timestamp unpacked: %v", err)
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	key := newKey(t, 32)
+	client, _ := shadowaead.Chacha20Poly1305(key)
+	server, _ := shadowaead.Chacha20Poly1305(key)
+	client, server = shadowaead.WithTimestamp(client), shadowaead.WithTimestamp(server)
+
+	a, c := net.Pipe()
+	defer a.Close()
+	defer c.Close()
+	go shadowaead.NewConn(a, client).Write([]byte("shadowsocks"))
+	b := make([]byte, 64)
+	if n, err := shadowaead.NewConn(c, server).Read(b); err != nil || string(b[:n]) != "shadowsocks" {
+		t.Fatalf("Stream read %q, %v", b[:n], err)
+	}
+
+	pkt, err := shadowaead.Pack(make([]byte, 128), []byte("shadowsocks"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := shadowaead.Unpack(b, pkt, server); err != nil || string(p) != "shadowsocks" {
+		t.Fatalf("Packet unpacked %q, %v", p, err)
+	}
+}
@@ -0,0 +1,275 @@
+package shadowaead
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxUserCache is the maximum number of source IPs whose last user is remembered.
+const maxUserCache = 1 << 16
+
+// A UserSet is the set of users of a multi-user server. Users are told apart
+// by trial decryption with their keys, starting with the user last seen from
+// the same source IP.
+type UserSet struct {
+	users []User
+	mu    sync.Mutex
+	last  map[netip.Addr]int // index of the user last seen from an IP
+}
+
+// NewUserSet returns a UserSet of users.
+func NewUserSet(users []User) *UserSet {
+	return &UserSet{users: users, last: make(map[netip.Addr]int)}
+}
+
+// trial calls match with each user in the order of trial for ip until it
+// returns true, or an error to stop early, and returns the matching user.
+func (s *UserSet) trial(ip netip.Addr, match func(User) (bool, error)) (User, error) {
+	s.mu.Lock()
+	first, cached := s.last[ip]
+	s.mu.Unlock()
+
+	if cached && first < len(s.users) {
+		if ok, err := match(s.users[first]); ok || err != nil {
+			return s.users[first], err
+		}
+	}
+	for i, u := range s.users {
+		if cached && i == first {
+			continue
+		}
+		ok, err := match(u)
+		if err != nil {
+			return u, err
+		}
+		if ok {
+			s.mu.Lock()
+			if len(s.last) >= maxUserCache {
+				s.last = make(map[netip.Addr]int)
+			}
+			s.last[ip] = i
+			s.mu.Unlock()
+			return u, nil
+		}
+	}
+	return User{}, ErrUnknownUser
+}
+
+var scratchPool = sync.Pool{New: func() any { return make([]byte, 64*1024) }}
+
+// Unpack decrypts pkt sent from ip with the key of the user who sealed it,
+// found by trial, and returns the user and a slice of dst containing the
+// decrypted payload. dst may overlap pkt.
+func (s *UserSet) Unpack(dst, pkt []byte, ip netip.Addr) (User, []byte, error) {
+	scratch := scratchPool.Get().([]byte)
+	defer scratchPool.Put(scratch)
+
+	var b []byte
+	u, err := s.trial(ip, func(u User) (bool, error) {
+		saltSize := u.Cipher.SaltSize()
+		if len(pkt) < saltSize {
+			return false, nil
+		}
+		aead, err := u.Cipher.Decrypter(pkt[:saltSize])
+		if err != nil {
+			return false, err
+		}
+		if len(pkt) < saltSize+aead.Overhead() || len(scratch) < len(pkt) {
+			return false, nil
+		}
+		b, err = aead.Open(scratch[:0], _zerononce[:aead.NonceSize()], pkt[saltSize:], nil)
+		return err == nil, nil
+	})
+	if err != nil {
+		return u, nil, err
+	}
+	if SaltFilterOf(u.Cipher).check(pkt[:u.Cipher.SaltSize()]) {
+		return u, nil, ErrRepeatedSalt
+	}
+	if b, err = openTimestamp(u.Cipher, b); err != nil {
+		return u, nil, err
+	}
+	if len(dst) < len(b) {
+		return u, nil, io.ErrShortBuffer
+	}
+	return u, dst[:copy(dst, b)], nil
+}
+
+// initUserReader reads the salt and the first length chunk of a request, and
+// finds the user whose key authenticates them.
+func (c *streamConn) initUserReader() error {
+	var ip netip.Addr
+	if ta, ok := c.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = ta.AddrPort().Addr()
+	}
+
+	var buf []byte // bytes read so far
+	fill := func(n int) error {
+		if len(buf) >= n {
+			return nil
+		}
+		b := make([]byte, n)
+		copy(b, buf)
+		_, err := io.ReadFull(c.Conn, b[len(buf):])
+		buf = b
+		return err
+	}
+
+	var chunk [2 + 16]byte
+	var saltSize int
+	u, err := c.users.trial(ip, func(u User) (bool, error) {
+		saltSize = u.Cipher.SaltSize()
+		if err := fill(saltSize); err != nil {
+			return false, err
+		}
+		aead, err := u.Cipher.Decrypter(buf[:saltSize])
+		if err != nil {
+			return false, err
+		}
+		if err := fill(saltSize + 2 + aead.Overhead()); err != nil {
+			return false, err
+		}
+		if 2+aead.Overhead() > len(chunk) {
+			return false, nil
+		}
+		b := chunk[:2+aead.Overhead()]
+		copy(b, buf[saltSize:])
+		_, err = aead.Open(b[:0], _zerononce[:aead.NonceSize()], b, nil)
+		return err == nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	salt := buf[:saltSize]
+	aead, err := u.Cipher.Decrypter(salt)
+	if err != nil {
+		return err
+	}
+	if SaltFilterOf(u.Cipher).check(salt) {
+		return ErrRepeatedSalt
+	}
+
+	c.Cipher = u.Cipher
+	c.user = u.Name
+	c.r = newReader(io.MultiReader(bytes.NewReader(buf[saltSize:]), c.Conn), aead)
+	return c.readTimestamp()
+}
+
+// User returns the name of the user identified by the request on multi-user
+// servers, or an empty string.
+func (c *streamConn) User() string { return c.user }
+
+// NewUserConn wraps a stream-oriented net.Conn of a multi-user server. The
+// user is identified by the first read, after which User tells who it is.
+func NewUserConn(c net.Conn, users *UserSet) net.Conn {
+	return &streamConn{Conn: c, users: users}
+}
+
+type userPeer struct {
+	user     User
+	lastSeen time.Time
+}
+
+type userPacketConn struct {
+	net.PacketConn
+	users *UserSet
+	sync.Mutex
+	buf []byte // write lock
+
+	mu        sync.Mutex
+	peers     map[netip.AddrPort]*userPeer
+	lastPrune time.Time
+}
+
+// NewUserPacketConn wraps a net.PacketConn of a multi-user server. Replies
+// are encrypted with the key of the user who last sent from the address.
+func NewUserPacketConn(c net.PacketConn, users *UserSet) net.PacketConn {
+	const maxPacketSize = 64 * 1024
+	return &userPacketConn{
+		PacketConn: c,
+		users:      users,
+		buf:        make([]byte, maxPacketSize),
+		peers:      make(map[netip.AddrPort]*userPeer),
+		lastPrune:  time.Now(),
+	}
+}
+
+func (c *userPacketConn) peer(addr netip.AddrPort) *userPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[addr]
+}
+
+// User returns the name of the user who last sent from addr.
+func (c *userPacketConn) User(addr netip.AddrPort) string {
+	if p := c.peer(addr); p != nil {
+		return p.user.Name
+	}
+	return ""
+}
+
+// WriteToUDPAddrPort encrypts b and write to addr using the embedded PacketConn.
+func (c *userPacketConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	p := c.peer(addr)
+	if p == nil {
+		return 0, errNoSession
+	}
+	c.Lock()
+	defer c.Unlock()
+	buf, err := Pack(c.buf, b, p.user.Cipher)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(buf, net.UDPAddrFromAddrPort(addr))
+	return len(b), err
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *userPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errNoSession
+	}
+	return c.WriteToUDPAddrPort(b, ua.AddrPort())
+}
+
+// ReadFromUDPAddrPort reads from the embedded PacketConn and decrypts into b.
+func (c *userPacketConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	n, na, err := c.PacketConn.ReadFrom(b)
+	var addr netip.AddrPort
+	if ua, ok := na.(*net.UDPAddr); ok {
+		addr = ua.AddrPort()
+	}
+	if err != nil {
+		return n, addr, err
+	}
+	u, bb, err := c.users.Unpack(b, b[:n], addr.Addr())
+	if err != nil {
+		return n, addr, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastPrune) > packetSessionTimeout {
+		for k, v := range c.peers {
+			if now.Sub(v.lastSeen) > packetSessionTimeout {
+				delete(c.peers, k)
+			}
+		}
+		c.lastPrune = now
+	}
+	c.peers[addr] = &userPeer{user: u, lastSeen: now}
+	return len(bb), addr, nil
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *userPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDPAddrPort(b)
+	return n, net.UDPAddrFromAddrPort(addr), err
+}
@@ -0,0 +1,193 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// userCiphers returns users of different methods and salt sizes, and the
+// ciphers of their clients, each with a salt filter of its own.
+func userCiphers(t *testing.T) (users []shadowaead.User, clients []shadowaead.Cipher) {
+	for _, u := range []struct {
+		name string
+		size int
+		new  func([]byte) (shadowaead.Cipher, error)
+	}{
+		{"alice", 16, shadowaead.AESGCM},
+		{"bob", 32, shadowaead.Chacha20Poly1305},
+		{"carol", 32, shadowaead.AESGCM},
+	} {
+		key := newKey(t, u.size)
+		server, err := u.new(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := u.new(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, shadowaead.User{Name: u.name, Cipher: server})
+		clients = append(clients, client)
+	}
+	return users, clients
+}
+
+// fromConn is a connection reading r from ip.
+type fromConn struct {
+	*readConn
+	ip netip.Addr
+}
+
+func (c fromConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: c.ip.AsSlice()} }
+
+func userConn(set *shadowaead.UserSet, stream []byte, ip string) net.Conn {
+	return shadowaead.NewUserConn(fromConn{&readConn{r: bytes.NewReader(stream)}, netip.MustParseAddr(ip)}, set)
+}
+
+func TestUserSetStream(t *testing.T) {
+	users, clients := userCiphers(t)
+	set := shadowaead.NewUserSet(users)
+	b := make([]byte, 64)
+	for i, u := range users {
+		stream := captured(t, clients[i], []byte("shadowsocks"), true)
+		c := userConn(set, stream, "192.0.2.1")
+		if n, err := c.Read(b); err != nil || string(b[:n]) != "shadowsocks" {
+			t.Fatalf("Stream of %s read %q, %v", u.Name, b[:n], err)
+		}
+		if name := c.(interface{ User() string }).User(); name != u.Name {
+			t.Fatalf("Stream of %s identified as %q", u.Name, name)
+		}
+
+		c = userConn(set, stream, "192.0.2.2")
+		if _, err := c.Read(b); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+			t.Fatalf("Replayed stream of %s read: %v", u.Name, err)
+		}
+	}
+	for _, u := range users {
+		if s := shadowaead.SaltFilterOf(u.Cipher).Stats(); s.Entries != 1 {
+			t.Fatalf("Filter of %s holds %d salts, want 1", u.Name, s.Entries)
+		}
+	}
+}
+
+func TestUserSetPacket(t *testing.T) {
+	users, clients := userCiphers(t)
+	set := shadowaead.NewUserSet(users)
+	b := make([]byte, 64)
+	for i, u := range users {
+		pkt := captured(t, clients[i], []byte("shadowsocks"), false)
+		got, p, err := set.Unpack(b, pkt, netip.MustParseAddr("192.0.2.1"))
+		if err != nil || string(p) != "shadowsocks" {
+			t.Fatalf("Packet of %s unpacked %q, %v", u.Name, p, err)
+		}
+		if got.Name != u.Name {
+			t.Fatalf("Packet of %s identified as %q", u.Name, got.Name)
+		}
+
+		if _, _, err := set.Unpack(b, pkt, netip.MustParseAddr("192.0.2.2")); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+			t.Fatalf("Replayed packet of %s unpacked: %v", u.Name, err)
+		}
+	}
+	for _, u := range users {
+		if s := shadowaead.SaltFilterOf(u.Cipher).Stats(); s.Entries != 1 {
+			t.Fatalf("Filter of %s holds %d salts, want 1", u.Name, s.Entries)
+		}
+	}
+}
+
+// triedCipher is a Cipher counting the salts it is asked to decrypt.
+type triedCipher struct {
+	shadowaead.Cipher
+	tries int
+}
+
+func (c *triedCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
+	c.tries++
+	return c.Cipher.Decrypter(salt)
+}
+
+func TestUserSetCache(t *testing.T) {
+	users, clients := userCiphers(t)
+	tried := make([]*triedCipher, len(users))
+	for i := range users {
+		tried[i] = &triedCipher{Cipher: users[i].Cipher}
+		users[i].Cipher = tried[i]
+	}
+	set := shadowaead.NewUserSet(users)
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	for _, tc := range []struct {
+		user  int
+		tries []int // of each user, since the last packet
+	}{
+		{2, []int{1, 1, 1}},
+		{2, []int{0, 0, 1}}, // cached
+		{0, []int{1, 0, 1}}, // cache miss, then in order
+		{0, []int{1, 0, 0}},
+	} {
+		for _, c := range tried {
+			c.tries = 0
+		}
+		pkt := captured(t, clients[tc.user], []byte("shadowsocks"), false)
+		u, _, err := set.Unpack(make([]byte, 64), pkt, ip)
+		if err != nil || u.Name != users[tc.user].Name {
+			t.Fatalf("Packet of %s unpacked as %q: %v", users[tc.user].Name, u.Name, err)
+		}
+		for i, c := range tried {
+			if c.tries != tc.tries[i] {
+				t.Fatalf("Packet of %s tried %s %d times, want %d", users[tc.user].Name, users[i].Name, c.tries, tc.tries[i])
+			}
+		}
+	}
+
+	// another IP starts over
+	for _, c := range tried {
+		c.tries = 0
+	}
+	pkt := captured(t, clients[2], []byte("shadowsocks"), false)
+	if _, _, err := set.Unpack(make([]byte, 64), pkt, netip.MustParseAddr("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if tried[0].tries != 1 || tried[1].tries != 1 {
+		t.Fatal("Packet from another IP took the cache of the first")
+	}
+}
+
+func TestUserSetUnknown(t *testing.T) {
+	users, _ := userCiphers(t)
+	set := shadowaead.NewUserSet(users)
+	mallory := newCipher(t)
+
+	pkt := captured(t, mallory, []byte("shadowsocks"), false)
+	if _, _, err := set.Unpack(make([]byte, 64), pkt, netip.MustParseAddr("192.0.2.1")); !errors.Is(err, shadowaead.ErrUnknownUser) {
+		t.Fatalf("Packet of an unknown key unpacked: %v", err)
+	}
+	stream := captured(t, mallory, []byte("shadowsocks"), true)
+	if _, err := userConn(set, stream, "192.0.2.1").Read(make([]byte, 64)); !errors.Is(err, shadowaead.ErrUnknownUser) {
+		t.Fatalf("Stream of an unknown key read: %v", err)
+	}
+	for _, u := range users {
+		if s := shadowaead.SaltFilterOf(u.Cipher).Stats(); s.Entries != 0 {
+			t.Fatalf("Filter of %s holds %d salts of an unknown key", u.Name, s.Entries)
+		}
+	}
+}
+
+func TestUserPacketConnReply(t *testing.T) {
+	users, clients := userCiphers(t)
+	server := shadowaead.NewUserPacketConn(listenUDP(t), shadowaead.NewUserSet(users))
+	for i, u := range users {
+		client := shadowaead.NewPacketConn(listenUDP(t), clients[i])
+		exchange(t, client, server, []byte("ping"))
+		addr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+		if name := server.(interface{ User(netip.AddrPort) string }).User(addr); name != u.Name {
+			t.Fatalf("Packet of %s identified as %q", u.Name, name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once shutdown begins. UDP listeners then stop creating NAT
+// sessions while existing ones carry on.
+var draining atomic.Bool
+
+// conns tracks TCP connections and UDP NAT sessions in progress.
+var conns tracker
+
+// A tracker keeps track of closers in use, so that shutdown can wait for
+// them to be done and close those left.
+type tracker struct {
+	mu      sync.Mutex
+	active  map[*io.Closer]struct{}
+	drained chan struct{} // closed once active empties while draining
+}
+
+// track adds c until the returned func is called.
+func (t *tracker) track(c io.Closer) (done func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil {
+		t.active = make(map[*io.Closer]struct{})
+	}
+	k := &c
+	t.active[k] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.active, k)
+		if t.drained != nil && len(t.active) == 0 {
+			close(t.drained)
+			t.drained = nil
+		}
+	}
+}
+
+// drain waits up to timeout for the tracked closers to be done, then closes
+// those left and returns their number.
+func (t *tracker) drain(timeout time.Duration) int {
+	t.mu.Lock()
+	if len(t.active) == 0 {
+		t.mu.Unlock()
+		return 0
+	}
+	drained := make(chan struct{})
+	t.drained = drained
+	t.mu.Unlock()
+
+	select {
+	case <-drained:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	return t.cut()
+}
+
+// cut closes the tracked closers and stops tracking them, returning their
+// number.
+func (t *tracker) cut() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.active)
+	for k := range t.active {
+		(*k).Close()
+		delete(t.active, k)
+	}
+	return n
+}
+
+// shutdown stops accepting TCP connections and creating UDP NAT sessions,
+// waits up to timeout for those in progress to finish, and cuts the rest.
+func shutdown(timeout time.Duration) {
+	draining.Store(true)
+	managed.Lock()
+	defer managed.Unlock()
+	stopServices(false)
+	logger.Info("shutting down, waiting for connections to finish", "timeout", timeout)
+	if n := conns.drain(timeout); n > 0 {
+		logger.Warn("cut connections left", "count", n, "timeout", timeout)
+	}
+	stopServices(true)
+}
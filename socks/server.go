@@ -0,0 +1,268 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// An Authenticator authenticates clients with a method as defined in RFC 1928
+// section 3.
+type Authenticator interface {
+	// Method returns the METHOD of the authenticator.
+	Method() byte
+	// Authenticate runs the subnegotiation of the method on rw once selected,
+	// and returns the identity of the client, such as a username.
+	Authenticate(rw io.ReadWriter) (string, error)
+}
+
+// NoAuth is the Authenticator letting any client in, without subnegotiation.
+type NoAuth struct{}
+
+func (NoAuth) Method() byte                               { return MethodNoAuth }
+func (NoAuth) Authenticate(io.ReadWriter) (string, error) { return "", nil }
+
+// UserPassAuth is the Authenticator of username/password authentication as
+// defined in RFC 1929, reporting whether password is that of username.
+type UserPassAuth func(username, password string) bool
+
+func (UserPassAuth) Method() byte { return MethodUserPass }
+
+// Authenticate returns the username, even if authentication failed.
+func (auth UserPassAuth) Authenticate(rw io.ReadWriter) (string, error) {
+	buf := make([]byte, 1+1+255+1+255)
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		return "", err
+	}
+	username := string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return username, err
+	}
+	if !auth(username, string(buf[:plen])) {
+		rw.Write([]byte{1, 1}) // VER STATUS failure
+		return username, ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{1, 0}); err != nil { // VER STATUS success
+		return username, err
+	}
+	return username, nil
+}
+
+// negotiate selects the first of auths that the client on rw offers, and
+// authenticates the client with it.
+func negotiate(rw io.ReadWriter, auths []Authenticator) (string, error) {
+	buf := make([]byte, 255)
+	// read VER, NMETHODS, METHODS
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+	nmethods := buf[1]
+	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
+		return "", err
+	}
+	for _, a := range auths {
+		for _, m := range buf[:nmethods] {
+			if m != a.Method() {
+				continue
+			}
+			// write VER METHOD
+			if _, err := rw.Write([]byte{5, m}); err != nil {
+				return "", err
+			}
+			return a.Authenticate(rw)
+		}
+	}
+	rw.Write([]byte{5, MethodNoAcceptable})
+	return "", ErrAuthRequired
+}
+
+// readRequest reads the command and the destination of a request from r.
+func readRequest(r io.Reader) (byte, Addr, error) {
+	buf := make([]byte, MaxAddrLen)
+	// read VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(r, buf[:3]); err != nil {
+		return 0, nil, err
+	}
+	cmd := buf[1]
+	addr, err := readAddr(r, buf)
+	return cmd, addr, err
+}
+
+// A Request is a request of a SOCKS5 client, authenticated.
+type Request struct {
+	Cmd      byte
+	Addr     Addr     // DST.ADDR and DST.PORT
+	Username string   // identity of the client from its Authenticator
+	Conn     net.Conn // to the client
+
+	replied bool
+}
+
+// Reply writes the reply to r, with the code of ReplyError(err), or succeeded
+// if err is nil, and the bound address bnd, or 0.0.0.0:0 if nil. BIND
+// requests are replied to twice.
+func (r *Request) Reply(err error, bnd Addr) error {
+	r.replied = true
+	return WriteReply(r.Conn, err, bnd)
+}
+
+// A Handler handles a request of a command, replying to it with req.Reply,
+// and returns once done with the client. If it returns an error before
+// replying, the error is the reply.
+type Handler func(ctx context.Context, req *Request) error
+
+// A Server serves SOCKS5 clients as defined in RFC 1928, with a Handler for
+// each command supported.
+type Server struct {
+	// Authenticators are the methods clients may authenticate with, in order
+	// of preference. Any client is let in if empty.
+	Authenticators []Authenticator
+
+	// HandshakeTimeout limits the time for clients to authenticate and send
+	// their request, if positive.
+	HandshakeTimeout time.Duration
+
+	// Handlers of the commands, which are not supported if nil.
+	Connect      Handler
+	Bind         Handler
+	UDPAssociate Handler
+}
+
+// Serve accepts connections on l and serves them until l is closed or ctx
+// is done, when it closes l.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			defer c.Close()
+			s.ServeConn(ctx, c)
+		}()
+	}
+}
+
+// ServeConn authenticates the client on c, reads its request and handles it
+// with the Handler of its command, returning the error of the handshake or
+// of the handler. The handshake is abandoned if ctx is done.
+func (s *Server) ServeConn(ctx context.Context, c net.Conn) error {
+	if s.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Unix(1, 0)) })
+	auths := s.Authenticators
+	if len(auths) == 0 {
+		auths = []Authenticator{NoAuth{}}
+	}
+	username, err := negotiate(c, auths)
+	var cmd byte
+	var addr Addr
+	if err == nil {
+		cmd, addr, err = readRequest(c)
+	}
+	if !stop() {
+		return ctx.Err()
+	}
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		if errors.Is(err, ErrAddressNotSupported) {
+			WriteReply(c, err, nil)
+		}
+		return err
+	}
+
+	h := map[byte]Handler{CmdConnect: s.Connect, CmdBind: s.Bind, CmdUDPAssociate: s.UDPAssociate}[cmd]
+	if h == nil {
+		WriteReply(c, ErrCommandNotSupported, nil)
+		return ErrCommandNotSupported
+	}
+	req := &Request{Cmd: cmd, Addr: addr, Username: username, Conn: c}
+	err = h(ctx, req)
+	if err != nil && !req.replied {
+		WriteReply(c, err, nil)
+	}
+	return err
+}
+
+// Bind is a Handler of BIND requests, which listens on the host the client
+// connected to and replies with the address listened on. It accepts one
+// connection, from the host of the request if an IP address, replies with the
+// address of the peer and relays between the peer and the client.
+func Bind(ctx context.Context, req *Request) error {
+	host, _, err := net.SplitHostPort(req.Conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	if err := req.Reply(nil, ParseAddr(l.Addr().String())); err != nil {
+		return err
+	}
+
+	var want net.IP // of the peer, if given
+	if req.Addr[0] == AtypIPv4 || req.Addr[0] == AtypIPv6 {
+		want = net.IP(req.Addr[1 : len(req.Addr)-2])
+	}
+	for {
+		pc, err := l.Accept()
+		if err != nil {
+			req.Reply(err, nil)
+			return err
+		}
+		if want != nil && !want.IsUnspecified() && !want.Equal(pc.RemoteAddr().(*net.TCPAddr).IP) {
+			pc.Close()
+			continue
+		}
+		l.Close()
+		defer pc.Close()
+		if err := req.Reply(nil, ParseAddr(pc.RemoteAddr().String())); err != nil {
+			return err
+		}
+		return relay(req.Conn, pc)
+	}
+}
+
+// relay copies between left and right bidirectionally, closing the writing
+// side of each once the other is done.
+func relay(left, right net.Conn) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(right, left)
+		closeWrite(right)
+		errc <- err
+	}()
+	_, err := io.Copy(left, right)
+	closeWrite(left)
+	if err1 := <-errc; err == nil {
+		err = err1
+	}
+	return err
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
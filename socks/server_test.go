@@ -0,0 +1,133 @@
+package socks_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// serve serves SOCKS5 with srv on a loopback listener, returning a client
+// connection to it.
+func serve(t *testing.T, srv *socks.Server) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go srv.Serve(ctx, l)
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func exchange(t *testing.T, c net.Conn, req []byte, n int) []byte {
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func request(cmd byte, addr string) []byte {
+	return append([]byte{5, cmd, 0}, socks.ParseAddr(addr)...)
+}
+
+func TestServerConnect(t *testing.T) {
+	srv := &socks.Server{
+		Authenticators: []socks.Authenticator{socks.UserPassAuth(func(user, password string) bool {
+			return user == "alice" && password == "secret"
+		})},
+		Connect: func(ctx context.Context, req *socks.Request) error {
+			if req.Username != "alice" || req.Addr.String() != "example.com:80" {
+				t.Errorf("Request from %q to %v", req.Username, req.Addr)
+			}
+			return socks.ErrConnectionRefused
+		},
+	}
+
+	c := serve(t, srv)
+	if b := exchange(t, c, []byte{5, 1, socks.MethodNoAuth}, 2); !bytes.Equal(b, []byte{5, socks.MethodNoAcceptable}) {
+		t.Fatalf("Method for a client without password: %v", b)
+	}
+
+	c = serve(t, srv)
+	exchange(t, c, []byte{5, 2, socks.MethodNoAuth, socks.MethodUserPass}, 2)
+	if b := exchange(t, c, []byte("\x01\x05alice\x03bad"), 2); b[1] == 0 {
+		t.Fatal("Wrong password accepted")
+	}
+
+	c = serve(t, srv)
+	if b := exchange(t, c, []byte{5, 2, socks.MethodNoAuth, socks.MethodUserPass}, 2); b[1] != socks.MethodUserPass {
+		t.Fatalf("Method selected: %d", b[1])
+	}
+	if b := exchange(t, c, []byte("\x01\x05alice\x06secret"), 2); b[1] != 0 {
+		t.Fatal("Password rejected")
+	}
+	if b := exchange(t, c, request(socks.CmdConnect, "example.com:80"), 10); b[1] != byte(socks.ErrConnectionRefused) {
+		t.Fatalf("Reply to CONNECT: %v", b)
+	}
+}
+
+func TestServerCommandNotSupported(t *testing.T) {
+	c := serve(t, &socks.Server{})
+	exchange(t, c, []byte{5, 1, socks.MethodNoAuth}, 2)
+	if b := exchange(t, c, request(socks.CmdUDPAssociate, "0.0.0.0:0"), 10); b[1] != byte(socks.ErrCommandNotSupported) {
+		t.Fatalf("Reply to UDP ASSOCIATE: %v", b)
+	}
+}
+
+func TestServerBind(t *testing.T) {
+	c := serve(t, &socks.Server{Bind: socks.Bind})
+	exchange(t, c, []byte{5, 1, socks.MethodNoAuth}, 2)
+	b := exchange(t, c, request(socks.CmdBind, "127.0.0.1:0"), 10)
+	if b[1] != 0 {
+		t.Fatalf("First reply to BIND: %v", b)
+	}
+	bnd := socks.SplitAddr(b[3:])
+
+	peer, err := net.Dial("tcp", bnd.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	b = make([]byte, 10)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != 0 {
+		t.Fatalf("Second reply to BIND: %v, %v", b, err)
+	}
+	if got := socks.SplitAddr(b[3:]).String(); got != peer.LocalAddr().String() {
+		t.Fatalf("Peer address %s, want %s", got, peer.LocalAddr())
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Fatalf("Relayed %q, %v", b, err)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	_, err := net.Dial("tcp", "127.0.0.1:1")
+	if err == nil {
+		t.Skip("port 1 open")
+	}
+	if e := socks.ReplyError(err); e != socks.ErrConnectionRefused {
+		t.Fatalf("Reply error of %v: %v", err, e)
+	}
+	if e := socks.ReplyError(errors.New("other")); e != socks.ErrGeneralFailure {
+		t.Fatalf("Reply error of other: %v", e)
+	}
+}
@@ -1,13 +1,18 @@
-// Package socks implements essential parts of SOCKS protocol.
+// Package socks implements SOCKS5, with a Server and fast-track handshakes,
+// and the CONNECT command of SOCKS4 and SOCKS4a.
 package socks
 
 import (
+	"errors"
 	"io"
 	"net"
 	"strconv"
+	"syscall"
 )
 
-// UDPEnabled is the toggle for UDP support
+// UDPEnabled is the toggle for UDP support of Handshake.
+//
+// Deprecated: Use a Server with an UDPAssociate Handler.
 var UDPEnabled = false
 
 // SOCKS request commands as defined in RFC 1928 section 4.
@@ -17,6 +22,13 @@ const (
 	CmdUDPAssociate = 3
 )
 
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xff
+)
+
 // SOCKS address types as defined in RFC 1928 section 5.
 const (
 	AtypIPv4       = 1
@@ -44,6 +56,13 @@ const (
 	InfoUDPAssociate        = Error(9)
 )
 
+// Errors of authentication: the client offers none of the methods required,
+// or failed username/password authentication as defined in RFC 1929.
+var (
+	ErrAuthRequired = errors.New("SOCKS client offers no acceptable authentication method")
+	ErrAuthFailed   = errors.New("SOCKS username/password authentication failed")
+)
+
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
 const MaxAddrLen = 1 + 1 + 255 + 2
 
@@ -171,25 +190,10 @@ func ParseAddr(s string) Addr {
 // Handshake fast-tracks SOCKS initialization to get target address to connect.
 func Handshake(rw io.ReadWriter) (Addr, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
-	buf := make([]byte, MaxAddrLen)
-	// read VER, NMETHODS, METHODS
-	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return nil, err
-	}
-	nmethods := buf[1]
-	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return nil, err
-	}
-	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
-		return nil, err
-	}
-	// read VER CMD RSV ATYP DST.ADDR DST.PORT
-	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
+	if _, err := negotiate(rw, []Authenticator{NoAuth{}}); err != nil {
 		return nil, err
 	}
-	cmd := buf[1]
-	addr, err := readAddr(rw, buf)
+	cmd, addr, err := readRequest(rw)
 	if err != nil {
 		return nil, err
 	}
@@ -212,3 +216,90 @@ func Handshake(rw io.ReadWriter) (Addr, error) {
 
 	return addr, err // skip VER, CMD, RSV fields
 }
+
+// WriteReply writes to w the reply to a request, with the code of
+// ReplyError(err), or succeeded if err is nil, and the bound address bnd, or
+// 0.0.0.0:0 if nil.
+func WriteReply(w io.Writer, err error, bnd Addr) error {
+	var rep byte
+	if err != nil {
+		rep = byte(ReplyError(err))
+	}
+	if bnd == nil {
+		bnd = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, err = w.Write(append([]byte{5, rep, 0}, bnd...)) // VER REP RSV BND.ADDR BND.PORT
+	return err
+}
+
+// ReplyError returns the error to reply with for err, as from dialing: err
+// itself if an Error, or the one matching the failure.
+func ReplyError(err error) Error {
+	var e Error
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return ErrHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTTLExpired
+	}
+	return ErrGeneralFailure
+}
+
+// readString reads a NUL-terminated string of at most 255 bytes from r.
+func readString(r io.Reader) ([]byte, error) {
+	b := make([]byte, 0, 16)
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, err
+		}
+		if c[0] == 0 {
+			return b, nil
+		}
+		if len(b) == 255 {
+			return nil, ErrAddressNotSupported
+		}
+		b = append(b, c[0])
+	}
+}
+
+// Handshake4 fast-tracks SOCKS4 and SOCKS4a initialization to get target
+// address to connect. Only CONNECT is supported.
+func Handshake4(rw io.ReadWriter) (Addr, error) {
+	// read VN CD DSTPORT DSTIP USERID NULL
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return nil, err
+	}
+	if _, err := readString(rw); err != nil {
+		return nil, err
+	}
+	cmd, port, ip := buf[1], buf[2:4], buf[4:8]
+	var addr Addr
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4a: DSTIP 0.0.0.x is followed by the domain name
+		host, err := readString(rw)
+		if err != nil {
+			return nil, err
+		}
+		addr = append(append(Addr{AtypDomainName, byte(len(host))}, host...), port...)
+	} else {
+		addr = append(append(Addr{AtypIPv4}, ip...), port...)
+	}
+	if cmd != CmdConnect {
+		rw.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0}) // request rejected
+		return nil, ErrCommandNotSupported
+	}
+	if _, err := rw.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0}); err != nil { // request granted
+		return nil, err
+	}
+	return addr, nil
+}
@@ -0,0 +1,63 @@
+package socks_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// socks4 returns a SOCKS4 request of cmd to ip and port 80 from userid,
+// followed by host if not empty, as SOCKS4a.
+func socks4(cmd byte, ip [4]byte, userid, host string) []byte {
+	b := append([]byte{4, cmd, 0, 80}, ip[:]...)
+	b = append(append(b, userid...), 0)
+	if host != "" {
+		b = append(append(b, host...), 0)
+	}
+	return b
+}
+
+func TestHandshake4(t *testing.T) {
+	granted := []byte{0, 90, 0, 0, 0, 0, 0, 0}
+	rejected := []byte{0, 91, 0, 0, 0, 0, 0, 0}
+	for _, tt := range []struct {
+		name  string
+		req   []byte
+		addr  string
+		err   error
+		reply []byte
+	}{
+		{"SOCKS4", socks4(socks.CmdConnect, [4]byte{192, 0, 2, 1}, "", ""), "192.0.2.1:80", nil, granted},
+		{"SOCKS4 userid", socks4(socks.CmdConnect, [4]byte{192, 0, 2, 1}, "alice", ""), "192.0.2.1:80", nil, granted},
+		{"SOCKS4a", socks4(socks.CmdConnect, [4]byte{0, 0, 0, 1}, "alice", "example.com"), "example.com:80", nil, granted},
+		{"SOCKS4a marker 0.0.0.255", socks4(socks.CmdConnect, [4]byte{0, 0, 0, 255}, "", "example.com"), "example.com:80", nil, granted},
+		{"0.0.0.0 is no marker", socks4(socks.CmdConnect, [4]byte{0, 0, 0, 0}, "", ""), "0.0.0.0:80", nil, granted},
+		{"0.0.1.1 is no marker", socks4(socks.CmdConnect, [4]byte{0, 0, 1, 1}, "", ""), "0.0.1.1:80", nil, granted},
+		{"BIND", socks4(socks.CmdBind, [4]byte{192, 0, 2, 1}, "", ""), "", socks.ErrCommandNotSupported, rejected},
+		{"SOCKS4a BIND", socks4(socks.CmdBind, [4]byte{0, 0, 0, 1}, "", "example.com"), "", socks.ErrCommandNotSupported, rejected},
+		{"short", []byte{4, 1, 0, 80, 192}, "", io.ErrUnexpectedEOF, nil},
+		{"userid unterminated", socks4(socks.CmdConnect, [4]byte{192, 0, 2, 1}, "alice", "")[:10], "", io.EOF, nil},
+		{"userid too long", socks4(socks.CmdConnect, [4]byte{192, 0, 2, 1}, strings.Repeat("a", 256), ""), "", socks.ErrAddressNotSupported, nil},
+		{"domain unterminated", socks4(socks.CmdConnect, [4]byte{0, 0, 0, 1}, "", "example.com")[:14], "", io.EOF, nil},
+	} {
+		var out bytes.Buffer
+		addr, err := socks.Handshake4(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(tt.req), &out})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && addr.String() != tt.addr {
+			t.Errorf("%s: address %v, want %s", tt.name, addr, tt.addr)
+		}
+		if !bytes.Equal(out.Bytes(), tt.reply) {
+			t.Errorf("%s: reply %v, want %v", tt.name, out.Bytes(), tt.reply)
+		}
+	}
+}
@@ -2,159 +2,355 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
-// Create a SOCKS server listening on addr and proxy to server.
-func socksLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("SOCKS proxy %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) })
+// Create a SOCKS server on l and proxy to server, with the settings of the
+// listener from ps.
+func socksLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn, ps func() proxySettings) {
+	logger.Info("SOCKS proxy", "local", l.Addr(), "server", server)
+	acceptLocal(l, func(c net.Conn) { socksLocalConn(c, server, shadow, ps()) })
 }
 
-// Create a TCP tunnel from addr to target via server.
-func tcpTun(addr, server, target string, shadow func(net.Conn) net.Conn) {
+// socksLocalConn serves the SOCKS5 client on c, proxying its CONNECT request
+// to server, with the settings of ps. The reply to CONNECT waits for the
+// connection to the server if config.DeferReply is set.
+func socksLocalConn(c net.Conn, server string, shadow func(net.Conn) net.Conn, ps proxySettings) {
+	rl := newRelayLog(c.RemoteAddr().String())
+	srv := &socks.Server{
+		HandshakeTimeout: config.HandshakeTimeout,
+		Connect: func(ctx context.Context, req *socks.Request) error {
+			rl.setUser(req.Username)
+			var reply func(rc net.Conn, err error)
+			if config.DeferReply {
+				reply = func(rc net.Conn, err error) {
+					var bnd socks.Addr
+					if err == nil {
+						bnd = socks.ParseAddr(rc.LocalAddr().String())
+					}
+					req.Reply(err, bnd)
+				}
+			} else if err := req.Reply(nil, nil); err != nil {
+				return err
+			}
+			relayLocal(c, req.Addr, server, shadow, rl, reply)
+			return nil
+		},
+	}
+	if ps.creds != nil {
+		srv.Authenticators = []socks.Authenticator{socks.UserPassAuth(func(user, password string) bool {
+			ok := ps.creds.check(user, password)
+			if !ok {
+				rl.Info("authentication failed", "client", c.RemoteAddr(), "user", user)
+			}
+			return ok
+		})}
+	}
+	if ps.udp {
+		srv.UDPAssociate = func(ctx context.Context, req *socks.Request) error {
+			rl.setUser(req.Username)
+			// the UDP socket listens on the address of the TCP listener
+			if err := req.Reply(nil, socks.ParseAddr(c.LocalAddr().String())); err != nil {
+				return err
+			}
+			// keep the connection until disconnect then free the UDP socket
+			buf := make([]byte, 1)
+			for {
+				_, err := c.Read(buf)
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					continue
+				}
+				rl.Debug("UDP associate end")
+				return nil
+			}
+		}
+	}
+	if err := srv.ServeConn(context.Background(), c); err != nil {
+		rl.Debug("failed to get target address", "err", err)
+	}
+}
+
+// Create a TCP tunnel from l to target via server.
+func tcpTun(l net.Listener, server, target string, shadow func(net.Conn) net.Conn) {
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
-		logf("invalid target address %q", target)
+		logger.Error("invalid target address", "target", target)
 		return
 	}
-	logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
-	tcpLocal(addr, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
+	logger.Info("TCP tunnel", "local", l.Addr(), "server", server, "target", target)
+	tcpLocal(l, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
 }
 
-// Listen on addr and proxy to server to reach target from getAddr.
-func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
-		return
-	}
+// Accept on l and proxy to server to reach target from getAddr, until l is closed.
+func tcpLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
+	acceptLocal(l, func(c net.Conn) { tcpLocalConn(c, server, shadow, getAddr) })
+}
 
+// acceptLocal accepts on l and serves each connection with serve, closing it
+// after, until l is closed.
+func acceptLocal(l net.Listener, serve func(net.Conn)) {
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %s", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn("failed to accept", "err", err)
 			continue
 		}
 
+		done := conns.track(c)
 		go func() {
 			defer c.Close()
-			tgt, err := getAddr(c)
-			if err != nil {
-
-				// UDP: keep the connection until disconnect then free the UDP socket
-				if err == socks.InfoUDPAssociate {
-					buf := make([]byte, 1)
-					// block here
-					for {
-						_, err := c.Read(buf)
-						if err, ok := err.(net.Error); ok && err.Timeout() {
-							continue
-						}
-						logf("UDP Associate End.")
-						return
-					}
-				}
+			defer done()
+			serve(c)
+		}()
+	}
+}
 
-				logf("failed to get target address: %v", err)
-				return
-			}
+// tcpLocalConn proxies c to server to reach target from getAddr.
+func tcpLocalConn(c net.Conn, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
+	rl := newRelayLog(c.RemoteAddr().String())
+	setHandshakeDeadline(c)
+	tgt, err := getAddr(c)
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		rl.Debug("failed to get target address", "err", err)
+		return
+	}
+	relayLocal(c, tgt, server, shadow, rl, nil)
+}
 
-			rc, err := net.Dial("tcp", server)
-			if err != nil {
-				logf("failed to connect to server %v: %v", server, err)
-				return
-			}
-			defer rc.Close()
-			if config.TCPCork {
-				rc = timedCork(rc, 10*time.Millisecond, 1280)
-			}
-			rc = shadow(rc)
+// relayLocal proxies c to tgt through server, for the relay of rl. If reply
+// is not nil, it replies to the client once connected to the server as rc,
+// or failed to with err.
+func relayLocal(c net.Conn, tgt socks.Addr, server string, shadow func(net.Conn) net.Conn, rl *relayLog, reply func(rc net.Conn, err error)) {
+	rl.target = tgt.String()
 
-			if _, err = rc.Write(tgt); err != nil {
-				logf("failed to send target address: %v", err)
-				return
-			}
+	rc, err := connectServer(server, tgt, shadow, rl)
+	if reply != nil {
+		reply(rc, err)
+	}
+	if err != nil {
+		return
+	}
+	defer rc.Close()
 
-			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
-			if err = relay(rc, c); err != nil {
-				logf("relay error: %v", err)
-			}
-		}()
+	rl.Debug("proxy", "client", c.RemoteAddr(), "server", server, "target", tgt)
+	err = relay(rc, c)
+	if err != nil {
+		rl.Debug("relay error", "err", err)
 	}
+	rl.end(err)
 }
 
-// Listen on addr for incoming connections.
-func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
-	l, err := net.Listen("tcp", addr)
+// connectServer connects to server through shadow and asks for tgt, for
+// the relay of rl, which counts the bytes sent and received. The target is
+// sent along with the first payload, so that the request carries some.
+// Failures to connect are logged to rl and recorded in the access log.
+func connectServer(server string, tgt socks.Addr, shadow func(net.Conn) net.Conn, rl *relayLog) (net.Conn, error) {
+	rc, err := net.Dial("tcp", server)
 	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
-		return
+		rl.Warn("failed to connect to server", "server", server, "err", err)
+		rl.done("dial", err)
+		return nil, err
+	}
+	if config.TCPCork {
+		rc = timedCork(rc, 10*time.Millisecond, 1280)
+	}
+	rc = &countedConn{shadow(rc), counters{&rl.ctr}}
+	return withTarget(rc, tgt, 50*time.Millisecond, rl), nil
+}
+
+// targetConn is a connection sending tgt ahead of the first write, or on
+// its own if nothing is written within a delay, as the target may speak
+// first.
+type targetConn struct {
+	net.Conn
+	mu    sync.Mutex
+	tgt   socks.Addr
+	timer *time.Timer
+}
+
+func withTarget(c net.Conn, tgt socks.Addr, d time.Duration, rl *relayLog) net.Conn {
+	tc := &targetConn{Conn: c, tgt: tgt}
+	tc.timer = time.AfterFunc(d, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		if tc.tgt == nil {
+			return
+		}
+		if _, err := tc.Conn.Write(tc.tgt); err != nil {
+			rl.Warn("failed to send target address", "err", err)
+			tc.Conn.Close()
+		}
+		tc.tgt = nil
+	})
+	return tc
+}
+
+func (c *targetConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.tgt == nil {
+		c.mu.Unlock()
+		return c.Conn.Write(b)
+	}
+	defer c.mu.Unlock()
+	c.timer.Stop()
+	buf := append(append(make([]byte, 0, len(c.tgt)+len(b)), c.tgt...), b...)
+	c.tgt = nil
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
 	}
+	return len(b), nil
+}
+
+func (c *targetConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
 
-	logf("listening TCP on %s", addr)
+// Accept incoming connections on l until it is closed.
+func tcpRemote(l net.Listener, shadow func(net.Conn) net.Conn) {
+	ctr := portCounter(l.Addr())
+	logger.Info("listening TCP", "addr", l.Addr())
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn("failed to accept", "err", err)
 			continue
 		}
 
+		release, reason := admit(c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr())
+		if reason != 0 {
+			metrics.rejected[reason].Add(1)
+			logger.Debug("client rejected", "client", c.RemoteAddr(), "reason", rejectReasonNames[reason])
+			c.Close()
+			continue
+		}
+		metrics.accepted.Add(1)
+		done := conns.track(c)
 		go func() {
 			defer c.Close()
+			defer done()
+			defer release()
+			rl := newRelayLog(c.RemoteAddr().String())
 			if config.TCPCork {
 				c = timedCork(c, 10*time.Millisecond, 1280)
 			}
-			sc := shadow(c)
+			rec := &recordConn{Conn: c}
+			sc := shadow(rec)
 
+			setHandshakeDeadline(c)
 			tgt, err := socks.ReadAddr(sc)
+			c.SetDeadline(time.Time{})
 			if err != nil {
-				logf("failed to get target address from %v: %v", c.RemoteAddr(), err)
-				// drain c to avoid leaking server behavioral features
-				// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
-				_, err = io.Copy(ioutil.Discard, c)
-				if err != nil {
-					logf("discard error: %v", err)
-				}
+				reason := readFailReason(err)
+				metrics.failed[reason].Add(1)
+				rl.Debug("failed to get target address", "client", c.RemoteAddr(), "err", err)
+				rl.done(failReasonNames[reason], err)
+				deflect(c, rec, rl, reason != failHandshakeTimeout)
 				return
 			}
+			rl.target = tgt.String()
 
-			rc, err := net.Dial("tcp", tgt.String())
+			var user string
+			if uc, ok := sc.(core.UserConn); ok {
+				user = uc.User()
+			}
+			rl.setUser(user)
+			q := quotaOf(user)
+			rec.stop()
+			untrack, ok := q.enter(c)
+			if !ok {
+				// authenticated users are not for the fallback to see
+				metrics.failed[failQuota].Add(1)
+				rl.Debug("user over quota")
+				rl.done(failReasonNames[failQuota], nil)
+				drainConn(c, rl)
+				return
+			}
+			defer untrack()
+
+			start := time.Now()
+			rc, err := dialTarget(tgt.String())
+			if errors.Is(err, errDenied) {
+				metrics.failed[failDenied].Add(1)
+				rl.Warn("target denied", "target", tgt)
+				rl.done(failReasonNames[failDenied], nil)
+				return
+			}
+			metrics.dialLatency.observe(time.Since(start))
 			if err != nil {
-				logf("failed to connect to target: %v", err)
+				metrics.failed[failDial].Add(1)
+				rl.Debug("failed to connect to target", "target", tgt, "err", err)
+				rl.done(failReasonNames[failDial], err)
 				return
 			}
 			defer rc.Close()
+			ctrs := append(connCounters(ctr, user), &rl.ctr)
+			if q != nil {
+				ctrs = append(ctrs, &q.ctr)
+			}
+			defer ctrs.open()()
+			up, down := connLimiters(l.Addr(), user)
+			rc = &countedConn{&limitedConn{rc, up, down}, ctrs}
 
-			logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
-			if err = relay(sc, rc); err != nil {
-				logf("relay error: %v", err)
+			rl.Debug("proxy", "client", c.RemoteAddr(), "target", tgt)
+			err = relay(sc, rc)
+			if err != nil {
+				rl.Debug("relay error", "err", err)
 			}
+			rl.end(err)
 		}()
 	}
 }
 
+// setHandshakeDeadline limits the time for a client to send its target
+// address on c to config.HandshakeTimeout, if set.
+func setHandshakeDeadline(c net.Conn) {
+	if config.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
+}
+
 // relay copies between left and right bidirectionally
 func relay(left, right net.Conn) error {
+	metrics.relays.Add(1)
+	defer metrics.relays.Add(-1)
 	var err, err1 error
 	var wg sync.WaitGroup
-	var wait = 5 * time.Second
+	l, r := left, right
+	closeRead := func(c net.Conn) { c.SetReadDeadline(time.Now().Add(config.HalfCloseTimeout)) }
+	if config.IdleTimeout > 0 {
+		// wrapped only if need be, as it hides ReadFrom and WriteTo of the sides
+		var last atomic.Int64 // of a read on either side
+		last.Store(time.Now().UnixNano())
+		l = &idleConn{Conn: left, last: &last}
+		r = &idleConn{Conn: right, last: &last}
+		closeRead = func(c net.Conn) { c.(*idleConn).closeRead(config.HalfCloseTimeout) }
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		_, err1 = io.Copy(right, left)
-		right.SetReadDeadline(time.Now().Add(wait)) // unblock read on right
+		_, err1 = io.Copy(r, l)
+		closeRead(r) // unblock read on right
 	}()
-	_, err = io.Copy(left, right)
-	left.SetReadDeadline(time.Now().Add(wait)) // unblock read on left
+	_, err = io.Copy(l, r)
+	closeRead(l) // unblock read on left
 	wg.Wait()
 	if err1 != nil && !errors.Is(err1, os.ErrDeadlineExceeded) { // requires Go 1.15+
 		return err1
@@ -165,6 +361,70 @@ func relay(left, right net.Conn) error {
 	return nil
 }
 
+// errIdle means that neither side of a relay read anything for the idle
+// timeout.
+var errIdle = errors.New("idle timeout")
+
+// idleConn is a side of a relay. Reads fail with errIdle once neither side
+// has read anything for config.IdleTimeout, if set, or time out at the
+// deadline given to closeRead.
+type idleConn struct {
+	net.Conn
+	last *atomic.Int64 // unix nanoseconds of the last read on either side
+
+	mu       sync.Mutex
+	deadline time.Time // of closeRead
+}
+
+// setDeadline sets the read deadline of c, returning it and whether it is
+// the one of closeRead. The zero deadline means none.
+func (c *idleConn) setDeadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setDeadlineLocked()
+}
+
+func (c *idleConn) setDeadlineLocked() (time.Time, bool) {
+	d, closing := c.deadline, !c.deadline.IsZero()
+	if idle := config.IdleTimeout; idle > 0 {
+		if t := time.Unix(0, c.last.Load()).Add(idle); !closing || t.Before(d) {
+			d, closing = t, false
+		}
+	}
+	c.Conn.SetReadDeadline(d)
+	return d, closing
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.setDeadline()
+	for {
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.last.Store(time.Now().UnixNano())
+		}
+		if n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, err
+		}
+		// reads on the other side may have moved the deadline meanwhile
+		d, closing := c.setDeadline()
+		switch {
+		case d.After(time.Now()):
+			continue
+		case closing, d.IsZero():
+			return 0, err
+		}
+		return 0, errIdle
+	}
+}
+
+// closeRead makes reads time out after d, for the other side is done.
+func (c *idleConn) closeRead(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = time.Now().Add(d)
+	c.setDeadlineLocked()
+}
+
 type corkedConn struct {
 	net.Conn
 	bufw   *bufio.Writer
@@ -7,11 +7,11 @@ import (
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	tcpLocal(addr, server, shadow, natLookup)
+func redirLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn) {
+	tcpLocal(l, server, shadow, natLookup)
 }
 
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
+func redir6Local(l net.Listener, server string, shadow func(net.Conn) net.Conn) {
 	panic("TCP6 redirect not supported")
 }
 
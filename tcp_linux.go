@@ -15,14 +15,14 @@ func getOrigDst(c net.Conn, ipv6 bool) (socks.Addr, error) {
 	panic("not a TCP connection")
 }
 
-// Listen on addr for netfilter redirected TCP connections
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) })
+// Accept on l for netfilter redirected TCP connections
+func redirLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn) {
+	logger.Info("TCP redirect", "local", l.Addr(), "server", server)
+	tcpLocal(l, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) })
 }
 
-// Listen on addr for netfilter redirected TCP IPv6 connections.
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP6 redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) })
+// Accept on l for netfilter redirected TCP IPv6 connections.
+func redir6Local(l net.Listener, server string, shadow func(net.Conn) net.Conn) {
+	logger.Info("TCP6 redirect", "local", l.Addr(), "server", server)
+	tcpLocal(l, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) })
 }
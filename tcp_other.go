@@ -6,10 +6,12 @@ import (
 	"net"
 )
 
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP redirect not supported")
+func redirLocal(l net.Listener, server string, shadow func(net.Conn) net.Conn) {
+	logger.Error("TCP redirect not supported")
+	l.Close()
 }
 
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP6 redirect not supported")
+func redir6Local(l net.Listener, server string, shadow func(net.Conn) net.Conn) {
+	logger.Error("TCP6 redirect not supported")
+	l.Close()
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// withTimeouts sets the idle and half-close timeouts of relays for the rest
+// of the test.
+func withTimeouts(t *testing.T, idle, halfClose time.Duration) {
+	saved := config
+	config.IdleTimeout, config.HalfCloseTimeout = idle, halfClose
+	t.Cleanup(func() { config = saved })
+}
+
+// startRelay relays between two pipes, returning their client and target
+// ends and the error of the relay once done.
+func startRelay(t *testing.T) (client, target net.Conn, done <-chan error) {
+	client, left := net.Pipe()
+	right, target := net.Pipe()
+	t.Cleanup(func() { client.Close(); target.Close() })
+	ch := make(chan error, 1)
+	go func() {
+		defer left.Close()
+		defer right.Close()
+		ch <- relay(left, right)
+	}()
+	return client, target, ch
+}
+
+// within waits for the error of done, failing unless it comes within d.
+func within(t *testing.T, done <-chan error, d time.Duration) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatalf("Relay still open after %v", d)
+		return nil
+	}
+}
+
+func TestRelayIdle(t *testing.T) {
+	withTimeouts(t, 100*time.Millisecond, time.Second)
+	start := time.Now()
+	_, _, done := startRelay(t)
+	if err := within(t, done, time.Second); !errors.Is(err, errIdle) {
+		t.Fatalf("Idle relay ended with %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("Idle relay closed after %v", d)
+	}
+}
+
+func TestRelayActive(t *testing.T) {
+	withTimeouts(t, 100*time.Millisecond, 0)
+	client, target, done := startRelay(t)
+	go func() {
+		b := make([]byte, 64)
+		for {
+			if _, err := target.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	// only one direction carries anything, which keeps the relay open
+	for i := 0; i < 10; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Active relay closed after %d writes: %v", i, err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Active relay ended with %v", err)
+	default:
+	}
+
+	client.Close()
+	if err := within(t, done, time.Second); err != nil {
+		t.Fatalf("Relay ended with %v", err)
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	for _, tt := range []struct {
+		idle, halfClose time.Duration
+	}{
+		{0, 0},
+		{0, 200 * time.Millisecond},
+		{time.Minute, 0},
+		{time.Minute, 200 * time.Millisecond},
+	} {
+		withTimeouts(t, tt.idle, tt.halfClose)
+		client, _, done := startRelay(t)
+		start := time.Now()
+		client.Close()
+		// the target says nothing, so the relay waits out the half-close timeout
+		if err := within(t, done, tt.halfClose+time.Second); err != nil {
+			t.Fatalf("Relay with idle timeout %v and half-close timeout %v ended with %v", tt.idle, tt.halfClose, err)
+		}
+		if d := time.Since(start); d < tt.halfClose || d > tt.halfClose+100*time.Millisecond {
+			t.Errorf("Relay with idle timeout %v and half-close timeout %v closed after %v", tt.idle, tt.halfClose, d)
+		}
+	}
+}
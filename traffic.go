@@ -0,0 +1,210 @@
+package main
+
+import (
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A counter counts the traffic of a server port or user.
+type counter struct {
+	up, down atomic.Int64 // payload bytes to and from targets
+	conns    atomic.Int64 // TCP connections and UDP sessions opened
+	active   atomic.Int64 // of which still open
+}
+
+// counters are the counters a connection counts in, such as those of its
+// port and user.
+type counters []*counter
+
+func (cs counters) addUp(n int) {
+	for _, c := range cs {
+		c.up.Add(int64(n))
+	}
+}
+
+func (cs counters) addDown(n int) {
+	for _, c := range cs {
+		c.down.Add(int64(n))
+	}
+}
+
+// open counts a connection opened, until the returned func is called.
+func (cs counters) open() (closed func()) {
+	for _, c := range cs {
+		c.conns.Add(1)
+		c.active.Add(1)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, c := range cs {
+				c.active.Add(-1)
+			}
+		})
+	}
+}
+
+// traffic counts the traffic of each server port and user.
+var traffic struct {
+	sync.Mutex
+	ports map[int]*counter
+	users map[string]*counter
+}
+
+// addrPort returns the port of a TCP or UDP address, or 0.
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+// portCounter returns the counter of the port of addr.
+func portCounter(addr net.Addr) *counter {
+	port := addrPort(addr)
+	traffic.Lock()
+	defer traffic.Unlock()
+	if traffic.ports == nil {
+		traffic.ports = make(map[int]*counter)
+	}
+	c := traffic.ports[port]
+	if c == nil {
+		c = new(counter)
+		traffic.ports[port] = c
+	}
+	return c
+}
+
+// connCounters returns the counters of a connection on the port counted by
+// ctr from user, which is empty if the server has a single user.
+func connCounters(ctr *counter, user string) counters {
+	if user == "" {
+		return counters{ctr}
+	}
+	traffic.Lock()
+	defer traffic.Unlock()
+	if traffic.users == nil {
+		traffic.users = make(map[string]*counter)
+	}
+	c := traffic.users[user]
+	if c == nil {
+		c = new(counter)
+		traffic.users[user] = c
+	}
+	return counters{ctr, c}
+}
+
+// A trafficStat is a snapshot of a counter.
+type trafficStat struct {
+	Up     int64 `json:"upload"`
+	Down   int64 `json:"download"`
+	Conns  int64 `json:"connections"`
+	Active int64 `json:"active"`
+}
+
+func (c *counter) stat() trafficStat {
+	return trafficStat{c.up.Load(), c.down.Load(), c.conns.Load(), c.active.Load()}
+}
+
+// trafficStats returns the traffic of each server port and user so far.
+func trafficStats() (ports map[int]trafficStat, users map[string]trafficStat) {
+	traffic.Lock()
+	defer traffic.Unlock()
+	ports = make(map[int]trafficStat, len(traffic.ports))
+	for port, c := range traffic.ports {
+		ports[port] = c.stat()
+	}
+	users = make(map[string]trafficStat, len(traffic.users))
+	for user, c := range traffic.users {
+		users[user] = c.stat()
+	}
+	return ports, users
+}
+
+// portTraffic returns the total bytes relayed on each port.
+func portTraffic() map[int]int64 {
+	ports, _ := trafficStats()
+	m := make(map[int]int64, len(ports))
+	for port, s := range ports {
+		m[port] = s.Up + s.Down
+	}
+	return m
+}
+
+// logTraffic logs the traffic of each server port and user every interval.
+func logTraffic(interval time.Duration) {
+	for range time.Tick(interval) {
+		ports, users := trafficStats()
+		for _, port := range slices.Sorted(maps.Keys(ports)) {
+			s := ports[port]
+			logger.Info("traffic", "port", port, "up", s.Up, "down", s.Down, "connections", s.Conns, "active", s.Active)
+		}
+		for _, user := range slices.Sorted(maps.Keys(users)) {
+			s := users[user]
+			logger.Info("traffic", "user", user, "up", s.Up, "down", s.Down, "connections", s.Conns, "active", s.Active)
+		}
+	}
+}
+
+// countedConn is a connection to a target counting bytes in ctrs.
+type countedConn struct {
+	net.Conn
+	ctrs counters
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.ctrs.addDown(n)
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.ctrs.addUp(n)
+	return n, err
+}
+
+// countedPacketConn is a UDP session with targets counting bytes in ctrs,
+// and counting itself open until closed. Closing also calls release, if
+// not nil.
+type countedPacketConn struct {
+	net.PacketConn
+	ctrs   counters
+	closed func()
+}
+
+func newCountedPacketConn(pc net.PacketConn, ctrs counters, release func()) net.PacketConn {
+	closed := ctrs.open()
+	if release != nil {
+		ctrsClosed := closed
+		closed = sync.OnceFunc(func() {
+			ctrsClosed()
+			release()
+		})
+	}
+	return &countedPacketConn{pc, ctrs, closed}
+}
+
+func (c *countedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.ctrs.addDown(n)
+	return n, addr, err
+}
+
+func (c *countedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.ctrs.addUp(n)
+	return n, err
+}
+
+func (c *countedPacketConn) Close() error {
+	c.closed()
+	return c.PacketConn.Close()
+}
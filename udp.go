@@ -1,12 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
@@ -20,112 +22,124 @@ const (
 
 const udpBufSize = 64 * 1024
 
-// Listen on laddr for UDP packets, encrypt and send to server to reach target.
-func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
+// Read UDP packets on c until it is closed, encrypt and send to server to reach target.
+func udpLocal(c *net.UDPConn, server, target string, shadow func(net.PacketConn) net.PacketConn) {
+	defer c.Close()
+
 	srvAddr, err := net.ResolveUDPAddr("udp", server)
 	if err != nil {
-		logf("UDP server address error: %v", err)
+		logger.Error("invalid UDP server address", "server", server, "err", err)
 		return
 	}
 
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
-		err = fmt.Errorf("invalid target address: %q", target)
-		logf("UDP target address error: %v", err)
-		return
-	}
-
-	lnAddr, err := net.ResolveUDPAddr("udp", laddr)
-	if err != nil {
-		logf("UDP listen address error: %v", err)
+		logger.Error("invalid UDP target address", "target", target)
 		return
 	}
 
-	c, err := net.ListenUDP("udp", lnAddr)
-	if err != nil {
-		logf("UDP local listen error: %v", err)
-		return
-	}
-	defer c.Close()
-
 	nm := newNATmap(config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
 	copy(buf, tgt)
 
-	logf("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
+	logger.Info("UDP tunnel", "local", c.LocalAddr(), "server", server, "target", target)
 	for {
 		n, raddr, err := c.ReadFromUDPAddrPort(buf[len(tgt):])
 		if err != nil {
-			logf("UDP local read error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn("UDP local read error", "err", err)
 			continue
 		}
 
+		if n < 3 {
+			logger.Debug("short SOCKS UDP packet", "client", raddr)
+			continue
+		}
 		pc := nm.Get(raddr)
 		if pc == nil {
+			if draining.Load() {
+				continue
+			}
+			tgt := socks.SplitAddr(buf[3:n])
+			if tgt == nil {
+				logger.Debug("failed to split target address from packet", "client", raddr)
+				continue
+			}
 			pc, err = net.ListenPacket("udp", "")
 			if err != nil {
-				logf("UDP local listen error: %v", err)
+				logger.Warn("UDP local listen error", "err", err)
 				continue
 			}
 
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, relayClient)
+			rl := newRelayLog(raddr.String())
+			rl.target = target
+			rl.Debug("UDP tunnel session", "client", raddr, "server", server, "target", target)
+			pc = newCountedPacketConn(shadow(pc), counters{&rl.ctr}, nil)
+			nm.Add(raddr, c, pc, relayClient, rl)
 		}
 
 		_, err = pc.WriteTo(buf[:len(tgt)+n], srvAddr)
 		if err != nil {
-			logf("UDP local write error: %v", err)
+			logger.Warn("UDP local write error", "err", err)
 			continue
 		}
 	}
 }
 
-// Listen on laddr for Socks5 UDP packets, encrypt and send to server to reach target.
-func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
+// Read Socks5 UDP packets on c until it is closed, encrypt and send to server to reach target.
+func udpSocksLocal(c *net.UDPConn, server string, shadow func(net.PacketConn) net.PacketConn) {
+	defer c.Close()
 	srvAddr, err := net.ResolveUDPAddr("udp", server)
 	if err != nil {
-		logf("UDP server address error: %v", err)
-		return
-	}
-
-	lnAddr, err := net.ResolveUDPAddr("udp", laddr)
-	if err != nil {
-		logf("UDP listen address error: %v", err)
+		logger.Error("invalid UDP server address", "server", server, "err", err)
 		return
 	}
 
-	c, err := net.ListenUDP("udp", lnAddr)
-	if err != nil {
-		logf("UDP local listen error: %v", err)
-		return
-	}
-	defer c.Close()
-
 	nm := newNATmap(config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
 
 	for {
 		n, raddr, err := c.ReadFromUDPAddrPort(buf)
 		if err != nil {
-			logf("UDP local read error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn("UDP local read error", "err", err)
 			continue
 		}
 
+		if n < 3 {
+			logger.Debug("short SOCKS UDP packet", "client", raddr)
+			continue
+		}
 		pc := nm.Get(raddr)
 		if pc == nil {
+			if draining.Load() {
+				continue
+			}
+			tgt := socks.SplitAddr(buf[3:n])
+			if tgt == nil {
+				logger.Debug("failed to split target address from packet", "client", raddr)
+				continue
+			}
 			pc, err = net.ListenPacket("udp", "")
 			if err != nil {
-				logf("UDP local listen error: %v", err)
+				logger.Warn("UDP local listen error", "err", err)
 				continue
 			}
-			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.Addr(buf[3:]))
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, socksClient)
+
+			rl := newRelayLog(raddr.String())
+			rl.target = tgt.String()
+			rl.Debug("UDP socks session", "client", raddr, "server", server, "target", rl.target)
+			pc = newCountedPacketConn(shadow(pc), counters{&rl.ctr}, nil)
+			nm.Add(raddr, c, pc, socksClient, rl)
 		}
 
 		_, err = pc.WriteTo(buf[3:n], srvAddr)
 		if err != nil {
-			logf("UDP local write error: %v", err)
+			logger.Warn("UDP local write error", "err", err)
 			continue
 		}
 	}
@@ -137,60 +151,102 @@ type UDPConn interface {
 	WriteToUDPAddrPort([]byte, netip.AddrPort) (int, error)
 }
 
-// Listen on addr for encrypted packets and basically do UDP NAT.
-func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
-	nAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		logf("UDP server address error: %v", err)
-		return
-	}
-	cc, err := net.ListenUDP("udp", nAddr)
-	if err != nil {
-		logf("UDP remote listen error: %v", err)
-		return
-	}
+// Read encrypted packets on cc until it is closed and basically do UDP NAT.
+// Packets are decrypted with the cipher of ciph current at the time; NAT
+// entries keep replying with the cipher of the packet which created them.
+func udpRemote(cc *net.UDPConn, ciph *cipherSwitch) {
 	defer cc.Close()
-	c := shadow(cc).(UDPConn)
 
 	nm := newNATmap(config.UDPTimeout)
+	ctr := portCounter(cc.LocalAddr())
 	buf := make([]byte, udpBufSize)
 
-	logf("listening UDP on %s", addr)
+	var cur core.Cipher
+	var c UDPConn
+	logger.Info("listening UDP", "addr", cc.LocalAddr())
 	for {
+		if ci := ciph.Load(); ci != cur {
+			cur, c = ci, ci.PacketConn(cc).(UDPConn)
+		}
 		n, raddr, err := c.ReadFromUDPAddrPort(buf)
 		if err != nil {
-			logf("UDP remote read error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) { // woken up to pick up a new cipher
+				cc.SetReadDeadline(time.Time{})
+				continue
+			}
+			logger.Debug("UDP remote read error", "err", err)
 			continue
 		}
 
 		tgtAddr := socks.SplitAddr(buf[:n])
 		if tgtAddr == nil {
-			logf("failed to split target address from packet: %q", buf[:n])
+			logger.Debug("failed to split target address from packet", "client", raddr)
 			continue
 		}
 
-		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+		addrs, err := resolveTarget(tgtAddr.String())
+		if errors.Is(err, errDenied) {
+			metrics.udpDenied.Add(1)
+			logger.Warn("UDP target denied", "client", raddr, "target", tgtAddr)
+			continue
+		}
 		if err != nil {
-			logf("failed to resolve target UDP address: %v", err)
+			logger.Debug("failed to resolve target UDP address", "client", raddr, "err", err)
 			continue
 		}
+		tgtUDPAddr := net.UDPAddrFromAddrPort(addrs[0])
 
 		payload := buf[len(tgtAddr):n]
 
 		pc := nm.Get(raddr)
 		if pc == nil {
+			if draining.Load() {
+				continue
+			}
+			release, reason := admit(raddr.Addr())
+			if reason != 0 {
+				metrics.rejected[reason].Add(1)
+				logger.Debug("UDP client rejected", "client", raddr, "reason", rejectReasonNames[reason])
+				continue
+			}
 			pc, err = net.ListenPacket("udp", "")
 			if err != nil {
-				logf("UDP remote listen error: %v", err)
+				release()
+				logger.Warn("UDP remote listen error", "err", err)
 				continue
 			}
 
-			nm.Add(raddr, c, pc, remoteServer)
+			var user string
+			if uc, ok := c.(core.UserPacketConn); ok {
+				user = uc.User(raddr)
+			}
+			q := quotaOf(user)
+			untrack, ok := q.enter(pc)
+			if !ok {
+				pc.Close()
+				release()
+				logger.Debug("UDP user over quota", "client", raddr, "user", user)
+				continue
+			}
+			rl := newRelayLog(raddr.String())
+			rl.setUser(user)
+			rl.target = tgtAddr.String()
+			rl.Debug("UDP remote session", "client", raddr, "target", tgtAddr)
+			ctrs := append(connCounters(ctr, user), &rl.ctr)
+			if q != nil {
+				ctrs = append(ctrs, &q.ctr)
+			}
+			up, down := connLimiters(cc.LocalAddr(), user)
+			pc = newCountedPacketConn(&limitedPacketConn{pc, up, down}, ctrs, func() { release(); untrack() })
+			nm.Add(raddr, c, pc, remoteServer, rl)
 		}
 
 		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
 		if err != nil {
-			logf("UDP remote write error: %v", err)
+			logger.Debug("UDP remote write error", "target", tgtAddr, "err", err)
 			continue
 		}
 	}
@@ -220,6 +276,9 @@ func (m *natmap) Set(key netip.AddrPort, pc net.PacketConn) {
 	m.Lock()
 	defer m.Unlock()
 
+	if _, ok := m.m[key]; !ok {
+		metrics.natEntries.Add(1)
+	}
 	m.m[key] = pc
 }
 
@@ -230,16 +289,20 @@ func (m *natmap) Del(key netip.AddrPort) net.PacketConn {
 	pc, ok := m.m[key]
 	if ok {
 		delete(m.m, key)
+		metrics.natEntries.Add(-1)
 		return pc
 	}
 	return nil
 }
 
-func (m *natmap) Add(peer netip.AddrPort, dst UDPConn, src net.PacketConn, role mode) {
+func (m *natmap) Add(peer netip.AddrPort, dst UDPConn, src net.PacketConn, role mode, rl *relayLog) {
 	m.Set(peer, src)
 
+	done := conns.track(src)
 	go func() {
-		timedCopy(dst, peer, src, m.timeout, role)
+		defer done()
+		err := timedCopy(dst, peer, src, m.timeout, role)
+		rl.end(err)
 		if pc := m.Del(peer); pc != nil {
 			pc.Close()
 		}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// userConfig is an entry in the user table of a multi-user server. Method
+// overrides the cipher of the server, and Key the password, for legacy AEAD
+// ciphers which are told apart by trial decryption.
+type userConfig struct {
+	Name      string       `json:"name"`
+	Method    string       `json:"method,omitempty"`
+	Password  string       `json:"password,omitempty"`
+	Key       string       `json:"key,omitempty"` // base64url-encoded
+	RateLimit *rateLimit   `json:"rate_limit,omitempty"`
+	Quota     *quotaConfig `json:"quota,omitempty"`
+}
+
+// loadUsers reads a JSON array of users from path and picks a cipher for
+// each. It also returns the entries read, for their other settings.
+func loadUsers(path, cipher string) ([]core.User, []userConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ucs []userConfig
+	if err := json.Unmarshal(b, &ucs); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	users, err := pickUsers(ucs, cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, u := range ucs {
+		if err := u.RateLimit.validate(); err != nil {
+			return nil, nil, fmt.Errorf("user %s: rate_limit: %v", u.Name, err)
+		}
+		if err := u.Quota.validate(); err != nil {
+			return nil, nil, fmt.Errorf("user %s: quota: %v", u.Name, err)
+		}
+	}
+	return users, ucs, nil
+}
+
+func pickUsers(ucs []userConfig, cipher string) ([]core.User, error) {
+	seen := make(map[string]bool)
+	var users []core.User
+	for i, u := range ucs {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user #%d: missing name", i+1)
+		}
+		if seen[u.Name] {
+			return nil, fmt.Errorf("user %s: duplicate name", u.Name)
+		}
+		seen[u.Name] = true
+		method := cipher
+		if u.Method != "" {
+			method = u.Method
+		}
+		var key []byte
+		if u.Key != "" {
+			k, err := base64.URLEncoding.DecodeString(u.Key)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: key: %v", u.Name, err)
+			}
+			key = k
+		}
+		ciph, err := core.PickCipher(method, key, u.Password)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", u.Name, err)
+		}
+		users = append(users, core.User{Name: u.Name, Cipher: ciph})
+	}
+	return users, nil
+}